@@ -0,0 +1,144 @@
+package cfggo
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/fs"
+	"reflect"
+	"strings"
+)
+
+// configFileVar is the --config flag, which loads the config from another file
+type configFileVar struct {
+	config *Structure
+}
+
+func (v *configFileVar) Set(filename string) error {
+	return v.config.useConfigFile(filename)
+}
+
+func (v *configFileVar) String() string {
+	if v.config == nil {
+		return ""
+	}
+	if handler, ok := v.config.handler().(*handlerFile); ok {
+		return handler.filename
+	}
+	return ""
+}
+
+// useConfigFile switches to filename as the config file, replacing the values loaded from the
+// previous one. Values from the environment, flags and Set are kept.
+func (c *Structure) useConfigFile(filename string) error {
+	c.mu.Lock()
+	handler, ok := c.configHandler.(*handlerFile)
+	if ok && handler.filename == filename {
+		c.mu.Unlock()
+		return nil
+	}
+	// A new handler, so a save or load already using the old one stays on the old file
+	next := &handlerFile{filename: filename}
+	if ok {
+		next.mode = handler.mode
+		next.backups = handler.backups
+	}
+	c.configHandler = next
+	c.resetFileValues()
+	c.publish()
+	c.mu.Unlock()
+
+	c.setupConfigSaver()
+	if err := c.loadConfig(context.Background()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// setVar is the repeatable --set key=value flag, which sets any key, including elements of
+// nested values such as map entries, eg. --set labels.env=prod
+type setVar struct {
+	config *Structure
+	values []string
+}
+
+func (v *setVar) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return ErrorWrapper(nil, 400, "invalid --set %s, expected key=value", s)
+	}
+	if err := v.config.setPath(key, value); err != nil {
+		return err
+	}
+	v.values = append(v.values, s)
+	return nil
+}
+
+func (v *setVar) String() string {
+	return strings.Join(v.values, ",")
+}
+
+// setPath parses value into the config key, or the element of a key's value, named by path
+func (c *Structure) setPath(path string, value string) error {
+	current, exists := c.Get(path)
+	if exists {
+		dv := &dynamicVar{config: c, name: path, want: reflect.TypeOf(current), source: SourceFlag}
+		return dv.Set(value)
+	}
+
+	// The longest key the path starts with holds the element
+	key := ""
+	for k := range c.state.Load().data {
+		if strings.HasPrefix(path, k+".") && len(k) > len(key) {
+			key = k
+		}
+	}
+	if key == "" {
+		return ErrorWrapper(nil, 404, "unknown config key %s", path)
+	}
+	current, _ = c.Get(key)
+	updated := reflect.New(reflect.TypeOf(current)).Elem()
+	updated.Set(copyValue(reflect.ValueOf(current)))
+	if err := c.setValuePath(updated, strings.Split(strings.TrimPrefix(path, key+"."), "."), ".", value); err != nil {
+		err = c.maskError(key, err)
+		return ErrorWrapper(err, 400, "invalid value for key %s: %v", path, err)
+	}
+	return c.setFrom(key, updated.Interface(), SourceFlag)
+}
+
+// createBuiltinFlags adds the --config, --set and hidden --completion flags, when enabled
+func (c *Structure) createBuiltinFlags() {
+	flags := c.flags()
+	if c.configFlag {
+		if flags.Lookup("config") != nil {
+			Logger.Error("Flag %s is already set, skipping...\n", "config")
+		} else {
+			flags.Var(&configFileVar{config: c}, "config", "Load the config from `file`")
+		}
+	}
+	if c.setFlag {
+		if flags.Lookup("set") != nil {
+			Logger.Error("Flag %s is already set, skipping...\n", "set")
+		} else {
+			flags.Var(&setVar{config: c}, "set", "Set the config `key=value`, can be repeated")
+		}
+	}
+	if c.completion && flags.Lookup("completion") == nil {
+		flags.Var(&completionVar{config: c}, "completion", "Print the completion script for `shell`")
+	}
+}
+
+// builtinFlags returns the --config, --set and --completion flags, when enabled, for ParseFlags
+func (c *Structure) builtinFlags() map[string]*flag.Flag {
+	builtins := make(map[string]*flag.Flag)
+	if c.configFlag {
+		builtins["config"] = &flag.Flag{Name: "config", Value: &configFileVar{config: c}, Usage: "Load the config from `file`"}
+	}
+	if c.setFlag {
+		builtins["set"] = &flag.Flag{Name: "set", Value: &setVar{config: c}, Usage: "Set the config `key=value`, can be repeated"}
+	}
+	if c.completion {
+		builtins["completion"] = &flag.Flag{Name: "completion", Value: &completionVar{config: c}, Usage: "Print the completion script for `shell`"}
+	}
+	return builtins
+}
@@ -0,0 +1,259 @@
+package cfggo
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// completionFlag describes a flag for a completion script
+type completionFlag struct {
+	name  string   // With its dashes, eg. -port, --listen-addr or -l
+	help  string   // From the help tag
+	value bool     // Takes a value
+	oneOf []string // Allowed values, from the oneof tag
+	path  string   // "file" or "dir" for keys tagged path:"true" or path:"dir"
+}
+
+// completionVar is the hidden --completion flag, which asks for a completion script, see Completion
+type completionVar struct {
+	config *Structure
+}
+
+func (v *completionVar) Set(shell string) error {
+	script, err := v.config.CompletionScript(shell)
+	if err != nil {
+		return err
+	}
+	v.config.completionScript = script
+	return nil
+}
+
+func (v *completionVar) String() string {
+	return ""
+}
+
+// Completion returns the completion script asked for with the --completion flag, or "" if it
+// wasn't given. The app prints it and exits after parsing its flags.
+func (c *Structure) Completion() string {
+	return c.completionScript
+}
+
+// CompletionScript returns a bash, zsh or fish script completing the flags of the config.
+// Values of keys with a oneof:"a b c" tag complete to those values, and keys with a
+// path:"true" (or path:"dir") tag complete to file (or directory) names.
+func (c *Structure) CompletionScript(shell string) (string, error) {
+	program := filepath.Base(c.flags().Name())
+	flags := c.completionFlags()
+	switch shell {
+	case "bash":
+		return bashCompletion(program, flags), nil
+	case "zsh":
+		return zshCompletion(program, flags), nil
+	case "fish":
+		return fishCompletion(program, flags), nil
+	}
+	return "", ErrorWrapper(nil, 400, "unsupported shell %s, expected bash, zsh or fish", shell)
+}
+
+// completionFlags returns the flags of the config, with the other flags of its flag set
+func (c *Structure) completionFlags() []completionFlag {
+	var flags []completionFlag
+	if c.posix == nil {
+		c.flags().VisitAll(func(f *flag.Flag) {
+			switch f.Value.(type) {
+			case *dynamicVar, *negatedVar, *completionVar:
+				return
+			}
+			_, usage := flag.UnquoteUsage(f)
+			cf := completionFlag{name: "-" + f.Name, help: usage, value: true}
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+				cf.value = false
+			}
+			if _, ok := f.Value.(*configFileVar); ok {
+				cf.path = "file"
+			}
+			flags = append(flags, cf)
+		})
+	} else {
+		for _, name := range []string{"config", "set"} {
+			if f := c.posix.extra[name]; f != nil {
+				_, usage := flag.UnquoteUsage(f)
+				cf := completionFlag{name: "--" + name, help: usage, value: true}
+				if name == "config" {
+					cf.path = "file"
+				}
+				flags = append(flags, cf)
+			}
+		}
+	}
+
+	c.walkConfigFields(reflect.ValueOf(c.parent), nil, func(path []string, field reflect.StructField, fieldValue reflect.Value) {
+		key := strings.Join(path, ".")
+		names, dv := c.completionNames(key)
+		if dv == nil {
+			return
+		}
+		cf := completionFlag{help: field.Tag.Get("help"), value: !dv.IsBoolFlag()}
+		cf.oneOf = c.oneOf[key]
+		switch field.Tag.Get("path") {
+		case "true", "file":
+			cf.path = "file"
+		case "dir":
+			cf.path = "dir"
+		}
+		for _, name := range names {
+			cf.name = name
+			flags = append(flags, cf)
+		}
+		if dv.IsBoolFlag() {
+			// -no-<key> takes no value either
+			negated := completionFlag{name: "-no-" + key, help: "Sets " + key + " to false"}
+			if c.posix != nil {
+				negated.name = "--no-" + c.posix.names[key]
+			}
+			flags = append(flags, negated)
+		}
+	})
+	return flags
+}
+
+// completionNames returns the flags of key, with their dashes, and its var, or nil if it has
+// no flag
+func (c *Structure) completionNames(key string) ([]string, *dynamicVar) {
+	if c.posix != nil {
+		name, ok := c.posix.names[key]
+		if !ok {
+			return nil, nil
+		}
+		names := []string{"--" + name}
+		if r, ok := c.posix.shorts[key]; ok {
+			names = append(names, "-"+string(r))
+		}
+		return names, c.posix.long[name]
+	}
+	f := c.flags().Lookup(key)
+	if f == nil {
+		return nil, nil
+	}
+	dv, ok := f.Value.(*dynamicVar)
+	if !ok || dv.config != c {
+		return nil, nil
+	}
+	return []string{"-" + key}, dv
+}
+
+var nonIdentifier = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+func bashCompletion(program string, flags []completionFlag) string {
+	function := "_" + nonIdentifier.ReplaceAllString(program, "_") + "_completion"
+	var names, values []string
+	for _, f := range flags {
+		names = append(names, f.name)
+		switch {
+		case len(f.oneOf) > 0:
+			values = append(values, fmt.Sprintf("        %s) COMPREPLY=($(compgen -W %s -- \"$cur\")); return ;;", f.name, shellQuote(strings.Join(f.oneOf, " "))))
+		case f.path == "file":
+			values = append(values, fmt.Sprintf("        %s) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;", f.name))
+		case f.path == "dir":
+			values = append(values, fmt.Sprintf("        %s) COMPREPLY=($(compgen -d -- \"$cur\")); return ;;", f.name))
+		case f.value:
+			values = append(values, fmt.Sprintf("        %s) return ;;", f.name))
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# bash completion for %s\n", program)
+	fmt.Fprintf(&b, "%s() {\n", function)
+	b.WriteString("    local cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	if len(values) > 0 {
+		b.WriteString("    case \"$prev\" in\n")
+		b.WriteString(strings.Join(values, "\n") + "\n")
+		b.WriteString("    esac\n")
+	}
+	b.WriteString("    if [[ \"$cur\" == -* ]]; then\n")
+	fmt.Fprintf(&b, "        COMPREPLY=($(compgen -W %s -- \"$cur\"))\n", shellQuote(strings.Join(names, " ")))
+	b.WriteString("    fi\n")
+	b.WriteString("}\n")
+	fmt.Fprintf(&b, "complete -o default -F %s %s\n", function, program)
+	return b.String()
+}
+
+func zshCompletion(program string, flags []completionFlag) string {
+	function := "_" + nonIdentifier.ReplaceAllString(program, "_")
+	var b strings.Builder
+	fmt.Fprintf(&b, "#compdef %s\n", program)
+	fmt.Fprintf(&b, "%s() {\n", function)
+	b.WriteString("    _arguments")
+	for _, f := range flags {
+		spec := f.name + "[" + zshEscape(f.help) + "]"
+		if f.value {
+			name := strings.TrimLeft(f.name, "-")
+			switch {
+			case len(f.oneOf) > 0:
+				spec += ":" + name + ":(" + strings.Join(f.oneOf, " ") + ")"
+			case f.path == "file":
+				spec += ":" + name + ":_files"
+			case f.path == "dir":
+				spec += ":" + name + ":_files -/"
+			default:
+				spec += ":" + name + ": "
+			}
+		}
+		b.WriteString(" \\\n        " + shellQuote(spec))
+	}
+	b.WriteString("\n}\n")
+	fmt.Fprintf(&b, "compdef %s %s\n", function, program)
+	return b.String()
+}
+
+func fishCompletion(program string, flags []completionFlag) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# fish completion for %s\n", program)
+	for _, f := range flags {
+		line := "complete -c " + program
+		switch name := strings.TrimLeft(f.name, "-"); {
+		case strings.HasPrefix(f.name, "--"):
+			line += " -l " + name
+		case len(name) == 1:
+			line += " -s " + name
+		default:
+			line += " -o " + name // Single dash long flags, as used by the flag package
+		}
+		if f.help != "" {
+			line += " -d " + fishQuote(f.help)
+		}
+		if f.value {
+			switch {
+			case len(f.oneOf) > 0:
+				line += " -x -a " + fishQuote(strings.Join(f.oneOf, " "))
+			case f.path == "file":
+				line += " -r -F"
+			case f.path == "dir":
+				line += " -x -a '(__fish_complete_directories)'"
+			default:
+				line += " -x"
+			}
+		}
+		b.WriteString(line + "\n")
+	}
+	return b.String()
+}
+
+// shellQuote single quotes s for bash and zsh
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// zshEscape escapes the characters _arguments gives a meaning to in descriptions
+func zshEscape(s string) string {
+	return strings.NewReplacer(`[`, `\[`, `]`, `\]`, `:`, `\:`).Replace(s)
+}
+
+// fishQuote single quotes s for fish
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
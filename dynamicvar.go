@@ -4,91 +4,374 @@ import (
 	"encoding"
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type dynamicVar struct {
 	config *Structure
 	name   string
 	want   reflect.Type
+	source Source // Recorded as the source of values set through this var
 }
 
 func (d *dynamicVar) Set(s string) error {
-	var value = reflect.New(d.want).Elem()
-	switch d.want.Kind() {
-	case reflect.Bool:
-		if len(s) == 0 {
-			value.SetBool(false)
+	if path, text, ok := cutElementPath(d.want, s); ok {
+		// Indexed form, eg. -routes 0.name=api, updates a single element of the current value
+		current, _ := d.config.Get(d.name)
+		value := reflect.New(d.want).Elem()
+		if current != nil {
+			value.Set(copyValue(reflect.ValueOf(current)))
+		}
+		if err := d.config.setValuePath(value, strings.Split(path, "."), ".", text); err != nil {
+			return d.config.maskError(d.name, err)
+		}
+		return d.config.setFrom(d.name, value.Interface(), d.source)
+	}
+
+	value, err := parseValue(d.want, s)
+	if err != nil {
+		return d.config.maskError(d.name, err)
+	}
+	if err := d.config.setFrom(d.name, value.Interface(), d.source); err != nil {
+		return err
+	}
+	// fmt.Println("Set", d.name, "to", value.Interface())
+	return nil
+}
+
+// IsBoolFlag lets bool flags be given without a value, like flag.Bool
+func (d *dynamicVar) IsBoolFlag() bool {
+	return d.want != nil && d.want.Kind() == reflect.Bool
+}
+
+// negatedVar is the -no-<key> flag of a bool config key, which sets it to false
+type negatedVar struct {
+	*dynamicVar
+}
+
+func (n *negatedVar) Set(s string) error {
+	b, err := parseBool(s)
+	if err != nil {
+		return err
+	}
+	return n.dynamicVar.Set(strconv.FormatBool(!b))
+}
+
+func (n *negatedVar) String() string {
+	return ""
+}
+
+func (d *dynamicVar) String() string {
+	if d.config == nil {
+		return ""
+	}
+	val, ok := d.config.Get(d.name)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprint(d.config.displayValue(d.name, val))
+}
+
+// parseValue converts the text s, as given in an environment variable or flag, to a value of type want
+func parseValue(want reflect.Type, s string) (reflect.Value, error) {
+	var value = reflect.New(want).Elem()
+	// Types that parse themselves take precedence over their underlying kind, eg. ByteSize is an int64
+	if unmarshaler, ok := value.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		if err := unmarshaler.UnmarshalText([]byte(s)); err != nil {
+			return value, err
+		}
+		return value, nil
+	}
+	if want == reflect.TypeOf(url.URL{}) || want == reflect.TypeOf(&url.URL{}) {
+		u, err := parseURL(s)
+		if err != nil {
+			return value, err
+		}
+		if want.Kind() == reflect.Ptr {
+			value.Set(reflect.ValueOf(u))
 		} else {
-			lowerFirst := strings.ToLower(s)
-			if lowerFirst[0] == '1' || lowerFirst[0] == 't' || lowerFirst[0] == 'y' {
-				value.SetBool(true)
-			}
+			value.Set(reflect.ValueOf(*u))
 		}
+		return value, nil
+	}
+	if want == reflect.TypeOf(time.Duration(0)) {
+		// Durations also accept a plain number of nanoseconds, handled as an int64 below
+		if d, err := time.ParseDuration(strings.TrimSpace(s)); err == nil {
+			value.SetInt(int64(d))
+			return value, nil
+		}
+	}
+	switch want.Kind() {
+	case reflect.Bool:
+		b, err := parseBool(s)
+		if err != nil {
+			return value, err
+		}
+		value.SetBool(b)
 	case reflect.String:
 		value.SetString(s)
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
 		if _, err := fmt.Sscan(s, value.Addr().Interface()); err != nil {
-			return err
+			return value, err
+		}
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), want.Bits())
+		if err != nil {
+			return value, err
 		}
+		value.SetFloat(f)
+	case reflect.Complex64, reflect.Complex128:
+		f, err := strconv.ParseComplex(strings.TrimSpace(s), want.Bits())
+		if err != nil {
+			return value, err
+		}
+		value.SetComplex(f)
+	case reflect.Ptr:
+		// An empty value leaves the pointer nil, meaning unset
+		if len(s) == 0 {
+			return value, nil
+		}
+		elem, err := parseValue(want.Elem(), s)
+		if err != nil {
+			return value, err
+		}
+		value.Set(reflect.New(want.Elem()))
+		value.Elem().Set(elem)
 	case reflect.Slice:
+		if isJSONLiteral(s) {
+			if err := json.Unmarshal([]byte(s), value.Addr().Interface()); err == nil {
+				return value, nil
+			} else if isStructElem(want) {
+				return value, err
+			}
+		}
 		split := strings.Split(s, ",")
-		value.Set(reflect.MakeSlice(d.want, len(split), len(split)))
+		value.Set(reflect.MakeSlice(want, len(split), len(split)))
 		for i, v := range split {
-			if _, err := fmt.Sscan(v, value.Index(i).Addr().Interface()); err != nil {
-				return err
+			elem, err := parseValue(want.Elem(), v)
+			if err != nil {
+				return value, err
 			}
+			value.Index(i).Set(elem)
 		}
 	case reflect.Map:
+		if isJSONLiteral(s) {
+			if err := json.Unmarshal([]byte(s), value.Addr().Interface()); err == nil {
+				return value, nil
+			} else if isStructElem(want) {
+				return value, err
+			}
+		}
 		split := strings.Split(s, ",")
-		value.Set(reflect.MakeMap(d.want))
+		value.Set(reflect.MakeMap(want))
 		for _, v := range split {
-			kv := strings.Split(v, ":")
-			if len(kv) != 2 {
-				return fmt.Errorf("invalid map value %s", v)
+			k, val, ok := strings.Cut(v, ":")
+			if !ok {
+				return value, fmt.Errorf("invalid map value %s", v)
 			}
-			key := reflect.New(d.want.Key()).Elem()
-			if _, err := fmt.Sscan(kv[0], key.Addr().Interface()); err != nil {
-				return err
+			key, err := parseValue(want.Key(), k)
+			if err != nil {
+				return value, err
 			}
-			val := reflect.New(d.want.Elem()).Elem()
-			if _, err := fmt.Sscan(kv[1], val.Addr().Interface()); err != nil {
-				return err
+			elem, err := parseValue(want.Elem(), val)
+			if err != nil {
+				return value, err
 			}
-			value.SetMapIndex(key, val)
+			value.SetMapIndex(key, elem)
 		}
 	default:
-		unmarshaler, ok := value.Addr().Interface().(encoding.TextUnmarshaler)
-		if ok {
-			if err := unmarshaler.UnmarshalText([]byte(s)); err != nil {
-				return err
-			}
-			return d.config.Set(d.name, value.Interface())
-		}
 		jsonUnmarshaler, ok := value.Addr().Interface().(json.Unmarshaler)
 		if ok {
 			if err := jsonUnmarshaler.UnmarshalJSON([]byte(strconv.Quote(s))); err != nil {
-				return err
+				return value, err
 			}
+			return value, nil
 		}
-		return fmt.Errorf("unsupported type %s", d.want)
+		if want.Kind() == reflect.Struct {
+			if err := json.Unmarshal([]byte(s), value.Addr().Interface()); err != nil {
+				return value, err
+			}
+			return value, nil
+		}
+		return value, fmt.Errorf("unsupported type %s", want)
 	}
-	if err := d.config.Set(d.name, value.Interface()); err != nil {
-		return err
+	return value, nil
+}
+
+// parseBool accepts 1/0, t/f, true/false, y/n, yes/no and on/off in any case. An empty string
+// is false, so an empty environment variable turns an option off.
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "t", "true", "y", "yes", "on":
+		return true, nil
+	case "", "0", "f", "false", "n", "no", "off":
+		return false, nil
 	}
-	// fmt.Println("Set", d.name, "to", value.Interface())
-	return nil
+	return false, fmt.Errorf("invalid boolean %q", s)
 }
 
-func (d *dynamicVar) String() string {
-	if d.config == nil {
-		return ""
+// parseURL parses an absolute URL. An empty string gives a nil URL.
+func parseURL(s string) (*url.URL, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
 	}
-	val, ok := d.config.Get(d.name)
-	if !ok {
-		return ""
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" {
+		return nil, fmt.Errorf("invalid URL %q: missing scheme", s)
+	}
+	return u, nil
+}
+
+// isJSONLiteral reports whether s looks like a JSON array or object
+func isJSONLiteral(s string) bool {
+	s = strings.TrimSpace(s)
+	return strings.HasPrefix(s, "[") || strings.HasPrefix(s, "{")
+}
+
+// isStructElem reports whether t is a slice, array or map whose elements are structs
+func isStructElem(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		elem := t.Elem()
+		for elem.Kind() == reflect.Ptr {
+			elem = elem.Elem()
+		}
+		return elem.Kind() == reflect.Struct && !isSelfDecoding(elem)
+	}
+	return false
+}
+
+// cutElementPath splits a flag value of the form 'path=value', eg. '0.name=api', used to set a
+// single element of a slice or map of structs
+func cutElementPath(want reflect.Type, s string) (path, text string, ok bool) {
+	if !isStructElem(want) || isJSONLiteral(s) {
+		return "", "", false
+	}
+	return strings.Cut(s, "=")
+}
+
+// setValuePath parses s into the element of v reached by following path, growing slices and
+// creating map entries as needed. Environment variables use "_" as the separator, so struct
+// field names containing it may span several path segments.
+func (c *Structure) setValuePath(v reflect.Value, path []string, sep string, s string) error {
+	if len(path) == 0 {
+		value, err := parseValue(v.Type(), s)
+		if err != nil {
+			return err
+		}
+		v.Set(value)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return c.setValuePath(v.Elem(), path, sep, s)
+	case reflect.Slice, reflect.Array:
+		index, err := strconv.Atoi(path[0])
+		if err != nil || index < 0 {
+			return fmt.Errorf("invalid index %s", path[0])
+		}
+		if index >= v.Len() {
+			if v.Kind() == reflect.Array {
+				return fmt.Errorf("index %d out of range", index)
+			}
+			grow := index + 1 - v.Len()
+			v.Set(reflect.AppendSlice(v, reflect.MakeSlice(v.Type(), grow, grow)))
+		}
+		return c.setValuePath(v.Index(index), path[1:], sep, s)
+	case reflect.Map:
+		// Struct elements take a single segment as their key, anything else uses the rest of the path
+		keyLen := len(path)
+		if isStructElem(v.Type()) {
+			keyLen = 1
+		}
+		key, err := parseValue(v.Type().Key(), strings.Join(path[:keyLen], sep))
+		if err != nil {
+			return err
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if existing := v.MapIndex(key); existing.IsValid() {
+			elem.Set(existing)
+		}
+		if err := c.setValuePath(elem, path[keyLen:], sep, s); err != nil {
+			return err
+		}
+		v.SetMapIndex(key, elem)
+		return nil
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name := c.getConfigNameFromField(field)
+			for n := 1; n <= len(path); n++ {
+				if strings.EqualFold(strings.Join(path[:n], sep), strings.ReplaceAll(name, ".", sep)) {
+					return c.setValuePath(v.Field(i), path[n:], sep, s)
+				}
+			}
+		}
+		return fmt.Errorf("unknown field %s", strings.Join(path, sep))
+	}
+	return fmt.Errorf("cannot set %s on %s", strings.Join(path, sep), v.Type())
+}
+
+// copyValue returns a deep copy of v, so elements can be changed without touching the original
+func copyValue(v reflect.Value) reflect.Value {
+	out := reflect.New(v.Type()).Elem()
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			out.Set(reflect.New(v.Type().Elem()))
+			out.Elem().Set(copyValue(v.Elem()))
+		}
+	case reflect.Slice:
+		if !v.IsNil() {
+			out.Set(reflect.MakeSlice(v.Type(), v.Len(), v.Len()))
+			for i := 0; i < v.Len(); i++ {
+				out.Index(i).Set(copyValue(v.Index(i)))
+			}
+		}
+	case reflect.Map:
+		if !v.IsNil() {
+			out.Set(reflect.MakeMapWithSize(v.Type(), v.Len()))
+			iter := v.MapRange()
+			for iter.Next() {
+				out.SetMapIndex(iter.Key(), copyValue(iter.Value()))
+			}
+		}
+	case reflect.Struct:
+		out.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if out.Field(i).CanSet() {
+				out.Field(i).Set(copyValue(v.Field(i)))
+			}
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(copyValue(v.Index(i)))
+		}
+	case reflect.Interface:
+		if !v.IsNil() {
+			out.Set(copyValue(v.Elem()))
+		}
+	default:
+		out.Set(v)
 	}
-	return fmt.Sprint(val)
+	return out
 }
@@ -0,0 +1,203 @@
+package cfggo
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// encryptedPrefix marks a config file value encrypted with AES-GCM
+const encryptedPrefix = "enc:v1:"
+
+// DefaultEncryptionKeyEnv is the environment variable holding the encryption key when no
+// KeyProvider is given
+const DefaultEncryptionKeyEnv = "CFGGO_ENCRYPTION_KEY"
+
+// KeyProvider supplies the AES key (16, 24 or 32 bytes) used for "enc:v1:" values
+type KeyProvider interface {
+	EncryptionKey() ([]byte, error)
+}
+
+// KeyProviderFunc adapts a function to a KeyProvider
+type KeyProviderFunc func() ([]byte, error)
+
+func (f KeyProviderFunc) EncryptionKey() ([]byte, error) {
+	return f()
+}
+
+// EnvKeyProvider reads the key from an environment variable, raw or hex or base64 encoded
+func EnvKeyProvider(name string) KeyProvider {
+	return KeyProviderFunc(func() ([]byte, error) {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("encryption key environment variable %s is not set", name)
+		}
+		return decodeKey([]byte(value))
+	})
+}
+
+// FileKeyProvider reads the key from a file, either raw or hex or base64 encoded
+func FileKeyProvider(filename string) KeyProvider {
+	return KeyProviderFunc(func() ([]byte, error) {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		return decodeKey(data)
+	})
+}
+
+// decodeKey takes the format of the key from its length: 16, 24 or 32 raw bytes, 48 or 64 hex
+// characters (a 24 or 32 byte key), or 44 base64 characters (a 32 byte key)
+func decodeKey(data []byte) ([]byte, error) {
+	if validKeyLen(len(data)) {
+		return data, nil
+	}
+	text := string(bytes.TrimSpace(data))
+	switch len(text) {
+	case 16, 24, 32:
+		return []byte(text), nil
+	case 48, 64:
+		key, err := hex.DecodeString(text)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key of %d characters must be hex encoded", len(text))
+		}
+		return key, nil
+	case 44:
+		key, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key of 44 characters must be base64 encoded")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("encryption key must be 16, 24 or 32 bytes, 48 or 64 hex characters, or 44 base64 characters")
+}
+
+func validKeyLen(n int) bool {
+	return n == 16 || n == 24 || n == 32
+}
+
+// EncryptValue encrypts plaintext into an "enc:v1:" value that can be pasted into a config file
+func EncryptValue(kp KeyProvider, plaintext string) (string, error) {
+	gcm, err := newGCM(kp)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptValue decrypts an "enc:v1:" value
+func DecryptValue(kp KeyProvider, value string) (string, error) {
+	encoded, ok := strings.CutPrefix(value, encryptedPrefix)
+	if !ok {
+		return "", fmt.Errorf("value is not encrypted")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(kp)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("encrypted value is too short")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func newGCM(kp KeyProvider) (cipher.AEAD, error) {
+	if kp == nil {
+		kp = EnvKeyProvider(DefaultEncryptionKeyEnv)
+	}
+	key, err := kp.EncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// isEncryptedValue reports whether raw is a JSON string holding an encrypted value
+func isEncryptedValue(raw json.RawMessage) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(raw), []byte(`"`+encryptedPrefix))
+}
+
+// decryptRaw decrypts a JSON string holding an encrypted value, returning the plaintext as
+// a JSON string, which decodeJSONValue parses into the wanted type
+func (c *Structure) decryptRaw(raw json.RawMessage) (json.RawMessage, error) {
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, err
+	}
+	plaintext, err := DecryptValue(c.encryptionKey(), value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(plaintext)
+}
+
+// encryptionKey returns the KeyProvider given with WithKeyProvider, or else one reading the
+// DefaultEncryptionKeyEnv environment variable if it is set, so loading and saving use the same
+// key. It returns nil if there is no key.
+func (c *Structure) encryptionKey() KeyProvider {
+	if c.keyProvider != nil {
+		return c.keyProvider
+	}
+	if _, ok := os.LookupEnv(DefaultEncryptionKeyEnv); ok {
+		return EnvKeyProvider(DefaultEncryptionKeyEnv)
+	}
+	return nil
+}
+
+// encryptForSave encrypts the values of secret keys when there is an encryption key, and of keys
+// that were loaded encrypted. Strings are encrypted as is, other values as JSON. The ciphertexts are
+// added to encrypted, to be recorded once the config is saved, as this runs under c.mu.RLock.
+func (c *Structure) encryptForSave(key string, value interface{}, encrypted map[string]string) (interface{}, error) {
+	kp := c.encryptionKey()
+	ciphertext, loaded := c.encryptedKeys[key]
+	if !loaded && (kp == nil || !c.isSecret(key)) {
+		return value, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := string(data)
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		plaintext = s
+	}
+	// Unchanged values keep their ciphertext, so saving doesn't rewrite them with a new nonce
+	if loaded {
+		if previous, err := DecryptValue(kp, ciphertext); err == nil && previous == plaintext {
+			encrypted[key] = ciphertext
+			return ciphertext, nil
+		}
+	}
+	ciphertext, err = EncryptValue(kp, plaintext)
+	if err != nil {
+		return nil, ErrorWrapper(err, 0, "cannot encrypt value for key %s: %v", key, err)
+	}
+	encrypted[key] = ciphertext
+	return ciphertext, nil
+}
@@ -3,6 +3,7 @@ package cfggo
 import (
 	"os"
 	"reflect"
+	"sort"
 	"strings"
 )
 
@@ -11,14 +12,50 @@ func (c *Structure) loadFromEnv() {
 		Logger.Debug("loadFromEnv: skipping environment variables")
 		return
 	}
+	envVars := make(map[string]string, len(c.configData))
 	for key := range c.configData {
-		envVar := strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+		envVars[strings.ToUpper(strings.ReplaceAll(key, ".", "_"))] = key
+	}
+	for envVar, key := range envVars {
 		if value, exists := os.LookupEnv(envVar); exists {
 			// Logger.Debug("found environment variable %s with value %s", envVar, value)
-			dv := &dynamicVar{config: c, name: key, want: reflect.TypeOf(c.configData[key])}
+			dv := &dynamicVar{config: c, name: key, want: reflect.TypeOf(c.configData[key]), source: SourceEnv}
 			if err := dv.Set(value); err != nil {
-				Logger.Info("Error setting config from environment variable %s=(%v): %v", envVar, value, err)
+				Logger.Info("Error setting config from environment variable %s=(%v): %v", envVar, c.displayValue(key, value), c.maskError(key, err))
 			}
 		}
+		if t := reflect.TypeOf(c.configData[key]); t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Map) {
+			c.loadIndexedFromEnv(key, envVar, envVars)
+		}
+	}
+}
+
+// loadIndexedFromEnv sets single elements of a slice or map from indexed environment variables,
+// eg. ROUTES_0_NAME=api or BACKENDS_PRIMARY_HOST=10.0.0.1. Map keys are lower cased.
+func (c *Structure) loadIndexedFromEnv(key string, envVar string, envVars map[string]string) {
+	prefix := envVar + "_"
+	var names []string
+	for _, env := range os.Environ() {
+		name, _, _ := strings.Cut(env, "=")
+		if _, isKey := envVars[name]; !isKey && strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	sort.Strings(names)
+
+	value := reflect.New(reflect.TypeOf(c.configData[key])).Elem()
+	value.Set(copyValue(reflect.ValueOf(c.configData[key])))
+	for _, name := range names {
+		path := strings.Split(strings.ToLower(strings.TrimPrefix(name, prefix)), "_")
+		if err := c.setValuePath(value, path, "_", os.Getenv(name)); err != nil {
+			Logger.Info("Error setting config from environment variable %s=(%v): %v", name, c.displayValue(key, os.Getenv(name)), c.maskError(key, err))
+			return
+		}
+	}
+	if err := c.setFrom(key, value.Interface(), SourceEnv); err != nil {
+		Logger.Info("Error setting config from environment variables %s*: %v", prefix, err)
 	}
 }
@@ -20,6 +20,11 @@ var (
 	Logger       logger       = slog.New(slog.NewTextHandler(os.Stdout, nil))
 )
 
+// defaultErrorWrapper returns err as is when there is no message, so callers can still match it
+// with errors.Is
 func defaultErrorWrapper(err error, errorcode int, msg string, args ...interface{}) error {
+	if msg == "" && err != nil {
+		return err
+	}
 	return fmt.Errorf(msg, args...)
 }
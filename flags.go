@@ -2,7 +2,11 @@ package cfggo
 
 import (
 	"flag"
+	"fmt"
+	"io"
+	"os"
 	"reflect"
+	"strings"
 )
 
 // NewFlag creates a new configuration item, using the type of the defaultValue
@@ -11,9 +15,185 @@ func (c *Structure) NewFlag(configVarName string, defaultValue interface{}, conf
 		c.configData = make(map[string]interface{})
 	}
 	//c.configData[configVarName] = defaultValue
-	if flag.Lookup(configVarName) != nil {
+	flags := c.flags()
+	if flags.Lookup(configVarName) != nil {
 		Logger.Error("Flag %s is already set, skipping...\n", configVarName)
 		return
 	}
-	flag.Var(&dynamicVar{config: c, name: configVarName, want: reflect.TypeOf(c.configData[configVarName])}, configVarName, configDescription)
+	dv := &dynamicVar{config: c, name: configVarName, want: reflect.TypeOf(c.configData[configVarName]), source: SourceFlag}
+	flags.Var(dv, configVarName, configDescription)
+	if dv.IsBoolFlag() && flags.Lookup("no-"+configVarName) == nil {
+		flags.Var(&negatedVar{dv}, "no-"+configVarName, "Sets "+configVarName+" to false")
+	}
+	if def, ok := c.defaults[configVarName]; ok {
+		// Show the struct's default rather than the value loaded from the file or environment
+		f := flags.Lookup(configVarName)
+		f.DefValue = ""
+		if def != nil && !reflect.ValueOf(def).IsZero() {
+			f.DefValue = fmt.Sprint(c.displayValue(configVarName, def))
+		}
+	}
+}
+
+// flags returns the flag set the config flags are added to
+func (c *Structure) flags() *flag.FlagSet {
+	if c.flagSet != nil {
+		return c.flagSet
+	}
+	return flag.CommandLine
+}
+
+// flagDescription returns the usage text of the flag for key: its help tag and environment variable
+func (c *Structure) flagDescription(key string) string {
+	description := c.GetHelpTag(key)
+	if env := c.envName(key); env != "" {
+		if description != "" {
+			description += " "
+		}
+		description += "(env " + env + ")"
+	}
+	return description
+}
+
+// envName returns the environment variable for key, or "" if the environment isn't used
+func (c *Structure) envName(key string) string {
+	if c.skipEnv {
+		return ""
+	}
+	return strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// setupFlagUsage replaces the usage function of the flag set with one listing the config flags
+// of each config, grouped by config and nested section
+func (c *Structure) setupFlagUsage() {
+	flags := c.flags()
+	name := flags.Name()
+	if flags == flag.CommandLine {
+		name = os.Args[0]
+	}
+	usage := func() {
+		fmt.Fprintf(flags.Output(), "Usage of %s:\n", name)
+		printFlagUsage(flags)
+	}
+	if flags == flag.CommandLine {
+		flag.Usage = usage // flag.CommandLine.Usage calls flag.Usage
+	} else {
+		flags.Usage = usage
+	}
+}
+
+// printFlagUsage prints the flags of flags that don't belong to a config, followed by the flags
+// of each config
+func printFlagUsage(flags *flag.FlagSet) {
+	out := flags.Output()
+	var configs []*Structure // The configs with flags in flags, found from the flags themselves
+	flags.VisitAll(func(f *flag.Flag) {
+		switch v := f.Value.(type) {
+		case *dynamicVar:
+			if !containsConfig(configs, v.config) {
+				configs = append(configs, v.config)
+			}
+			return
+		case *negatedVar, *completionVar:
+			return
+		}
+		typeName, usage := flag.UnquoteUsage(f)
+		if f.DefValue != "" && f.DefValue != "0" && f.DefValue != "false" {
+			usage += fmt.Sprintf(" (default %s)", f.DefValue)
+		}
+		printFlag(out, "-"+f.Name, typeName, usage)
+	})
+
+	for _, c := range configs {
+		c.printFlagUsage(out, func(key string) (string, *dynamicVar) {
+			f := flags.Lookup(key)
+			if f == nil {
+				return "", nil
+			}
+			dv, ok := f.Value.(*dynamicVar)
+			if !ok || dv.config != c {
+				return "", nil // Added by another config first
+			}
+			if dv.IsBoolFlag() {
+				// Bools take no value, like flag.Bool, and can be turned off with -no-<key>
+				return "-" + key + ", -no-" + key, dv
+			}
+			return "-" + key, dv
+		})
+	}
+}
+
+func containsConfig(configs []*Structure, c *Structure) bool {
+	for _, config := range configs {
+		if config == c {
+			return true
+		}
+	}
+	return false
+}
+
+// printFlagUsage prints the flags of c in the order of the struct fields, with a heading for
+// the config and each nested section. flagName returns how the flag for a key is written, and
+// its var, or nil if it has no flag.
+func (c *Structure) printFlagUsage(out io.Writer, flagName func(key string) (string, *dynamicVar)) {
+	section := "-"
+	c.walkConfigFields(reflect.ValueOf(c.parent), nil, func(path []string, field reflect.StructField, fieldValue reflect.Value) {
+		key := strings.Join(path, ".")
+		name, dv := flagName(key)
+		if dv == nil {
+			return
+		}
+
+		if prefix := strings.Join(path[:len(path)-1], "."); prefix != section {
+			section = prefix
+			if section == "" {
+				fmt.Fprintf(out, "\n%s:\n", c.name)
+			} else {
+				fmt.Fprintf(out, "\n%s (%s):\n", c.name, section)
+			}
+		}
+
+		var details []string
+		if def := c.defaults[key]; def != nil && !reflect.ValueOf(def).IsZero() {
+			if s, ok := c.displayValue(key, def).(string); ok {
+				details = append(details, fmt.Sprintf("default %q", s))
+			} else {
+				details = append(details, fmt.Sprintf("default %v", c.displayValue(key, def)))
+			}
+		}
+		if oneOf := c.oneOf[key]; len(oneOf) > 0 {
+			details = append(details, "one of "+strings.Join(oneOf, ", "))
+		}
+		if env := c.envName(key); env != "" {
+			details = append(details, "env "+env)
+		}
+		usage := field.Tag.Get("help")
+		if len(details) > 0 {
+			if usage != "" {
+				usage += " "
+			}
+			usage += "(" + strings.Join(details, ", ") + ")"
+		}
+		if dv.IsBoolFlag() {
+			printFlag(out, name, "", usage)
+		} else {
+			printFlag(out, name, configValueType(field.Type).String(), usage)
+		}
+	})
+}
+
+// printFlag prints a flag the way flag.PrintDefaults does
+func printFlag(out io.Writer, name, typeName, usage string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "  %s", name)
+	if typeName != "" {
+		b.WriteString(" " + typeName)
+	}
+	if b.Len() <= 4 {
+		b.WriteString("\t") // Single letter flags fit on one line
+	} else {
+		b.WriteString("\n    \t")
+	}
+	b.WriteString(strings.ReplaceAll(usage, "\n", "\n    \t"))
+	fmt.Fprintln(out, b.String())
 }
@@ -1,9 +1,21 @@
 package cfggo
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"math"
+	"net/netip"
+	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -179,13 +191,13 @@ func TestSaveAndLoadConfig(t *testing.T) {
 	config.configData["string_field"] = "test_value"
 
 	// Save the configuration
-	err := config.saveConfig()
+	err := config.Save(context.Background())
 	if err != nil {
 		t.Errorf("Expected no error during save, but got %v", err)
 	}
 
 	// Load the configuration
-	err = config.loadConfig()
+	err = config.Reload(context.Background())
 	if err != nil {
 		t.Errorf("Expected no error during load, but got %v", err)
 	}
@@ -208,14 +220,28 @@ func TestEnvironmentVariables(t *testing.T) {
 	}
 }
 
+// resetCommandLine replaces flag.CommandLine with a new, parsed set holding only the testing
+// flags, dropping the config flags added by earlier tests
+func resetCommandLine() {
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Name, "test.") {
+			flags.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	flags.Parse(nil) // testing.Verbose panics if flag.CommandLine isn't parsed
+	flag.CommandLine = flags
+}
+
 func TestCommandLineFlags(t *testing.T) {
+	resetCommandLine()
 	flag.String("string_field", "flag_value", "string field")
 	flag.Parse()
 
 	config := NewTestConfig()
 	config.Init(config, WithFileConfig("test.json"))
 	// Reset flags for other tests
-	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	resetCommandLine()
 
 	// Modify the TestEnvironmentVariables test
 	t.Run("TestEnvironmentVariables", func(t *testing.T) {
@@ -241,7 +267,7 @@ func TestCommandLineFlags(t *testing.T) {
 		config.configData["string_field"] = "test_value"
 
 		// Save the configuration
-		err := config.saveConfig()
+		err := config.Save(context.Background())
 		if err != nil {
 			t.Errorf("Expected no error during save, but got %v", err)
 		}
@@ -263,3 +289,1448 @@ func TestCommandLineFlags(t *testing.T) {
 		t.Errorf("Expected 'test_value', but got %v", config.StringField())
 	}
 }
+
+type NestedTestConfig struct {
+	Structure
+	Name func() string `json:"name" help:"Test field"`
+	DB   struct {
+		Host func() string `json:"host" help:"Test field"`
+		Port func() int    `json:"port" help:"Test field"`
+	} `json:"db"`
+}
+
+func TestNestedConfig(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "nested.json")
+	if err := os.WriteFile(filename, []byte(`{"name":"app","db":{"host":"db.local","port":5432}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("DB_PORT", "6543")
+	defer os.Unsetenv("DB_PORT")
+
+	config := &NestedTestConfig{}
+	config.Init(config, WithFileConfig(filename))
+
+	if config.DB.Host() != "db.local" {
+		t.Errorf("Expected 'db.local', but got %v", config.DB.Host())
+	}
+	if config.DB.Port() != 6543 {
+		t.Errorf("Expected 6543, but got %v", config.DB.Port())
+	}
+	if err := config.Set("db.host", "db.remote"); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved map[string]interface{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	db, ok := saved["db"].(map[string]interface{})
+	if !ok || db["host"] != "db.remote" || db["port"] != float64(6543) {
+		t.Errorf("Expected nested db object, but got %s", data)
+	}
+}
+
+type PlainTestConfig struct {
+	Structure
+	Port    int           `config:"port" help:"Test field"`
+	Timeout time.Duration `config:"timeout" help:"Test field"`
+	Host    func() string `json:"host" help:"Test field"`
+}
+
+func TestPlainFields(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "plain.json")
+	if err := os.WriteFile(filename, []byte(`{"timeout":5000000000}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &PlainTestConfig{Port: 8080, Host: DefaultValue("localhost")}
+	config.Init(config, WithFileConfig(filename), WithSkipEnvironment())
+
+	if config.Port != 8080 {
+		t.Errorf("Expected 8080, but got %v", config.Port)
+	}
+	if config.Timeout != 5*time.Second {
+		t.Errorf("Expected 5s, but got %v", config.Timeout)
+	}
+	if err := config.Set("port", 9090); err != nil {
+		t.Fatal(err)
+	}
+	if config.Port != 9090 {
+		t.Errorf("Expected 9090, but got %v", config.Port)
+	}
+	if value, _ := config.Get("port"); value != 9090 {
+		t.Errorf("Expected 9090, but got %v", value)
+	}
+	if config.Host() != "localhost" {
+		t.Errorf("Expected 'localhost', but got %v", config.Host())
+	}
+}
+
+type testRoute struct {
+	Name     string        `json:"name"`
+	Upstream string        `json:"upstream"`
+	Timeout  time.Duration `json:"timeout"`
+}
+
+func (r testRoute) Validate() error {
+	if r.Name == "" {
+		return errors.New("route name is required")
+	}
+	return nil
+}
+
+type testBackend struct {
+	Host     string `json:"host"`
+	MaxConns int    `json:"max_conns"`
+}
+
+type RoutesTestConfig struct {
+	Structure
+	Routes   func() []testRoute            `json:"routes" help:"Test field"`
+	Backends func() map[string]testBackend `json:"backends" help:"Test field"`
+}
+
+func TestStructElements(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(filename, []byte(`{"routes":[{"name":"api","upstream":"http://api"}],"backends":{"primary":{"host":"10.0.0.1"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("ROUTES_1_NAME", "web")
+	os.Setenv("ROUTES_1_TIMEOUT", "5s")
+	os.Setenv("BACKENDS_PRIMARY_MAX_CONNS", "10")
+	defer os.Unsetenv("ROUTES_1_NAME")
+	defer os.Unsetenv("ROUTES_1_TIMEOUT")
+	defer os.Unsetenv("BACKENDS_PRIMARY_MAX_CONNS")
+
+	config := &RoutesTestConfig{}
+	config.Init(config, WithFileConfig(filename))
+
+	routes := config.Routes()
+	if len(routes) != 2 || routes[0].Upstream != "http://api" || routes[1].Name != "web" || routes[1].Timeout != 5*time.Second {
+		t.Errorf("Expected routes from file and env, but got %+v", routes)
+	}
+	if backend := config.Backends()["primary"]; backend.Host != "10.0.0.1" || backend.MaxConns != 10 {
+		t.Errorf("Expected backend from file and env, but got %+v", backend)
+	}
+
+	dv := &dynamicVar{config: &config.Structure, name: "routes", want: reflect.TypeOf([]testRoute{})}
+	if err := dv.Set("0.upstream=http://api2"); err != nil {
+		t.Fatal(err)
+	}
+	if config.Routes()[0].Upstream != "http://api2" || routes[0].Upstream != "http://api" {
+		t.Errorf("Expected only the new value to change, but got %+v and %+v", config.Routes(), routes)
+	}
+	if err := dv.Set(`[{"name":"only"}]`); err != nil || len(config.Routes()) != 1 {
+		t.Errorf("Expected JSON literal to replace routes, but got %+v (%v)", config.Routes(), err)
+	}
+	if err := dv.Set("2.upstream=http://nameless"); err == nil {
+		t.Errorf("Expected validation error for route without a name")
+	}
+}
+
+func TestParseValue(t *testing.T) {
+	f := 2.5
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"1.5", float64(1.5)},
+		{"1.5", float32(1.5)},
+		{"1,2.5", []float64{1, 2.5}},
+		{"1+2i", complex128(1 + 2i)},
+		{"2.5", &f},
+		{"", (*float64)(nil)},
+		{"42", Some(42)},
+		{"", Optional[int]{}},
+	}
+
+	for _, test := range tests {
+		result, err := parseValue(reflect.TypeOf(test.expected), test.input)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q as %T: %v", test.input, test.expected, err)
+			continue
+		}
+		if !reflect.DeepEqual(result.Interface(), test.expected) {
+			t.Errorf("Expected %v, but got %v", test.expected, result.Interface())
+		}
+	}
+
+	if _, err := parseValue(reflect.TypeOf(float64(0)), "1.5x"); err == nil {
+		t.Errorf("Expected error parsing invalid float")
+	}
+}
+
+func TestUnits(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+		output   string
+	}{
+		{"512MiB", 512 * MiB, "512MiB"},
+		{"1.5GB", 1500 * MB, "1500MB"},
+		{"1024", KiB, "1KiB"},
+		{"100", 100 * Byte, "100B"},
+		{"75%", Percent(75), "75%"},
+		{"12.5", Percent(12.5), "12.5%"},
+		{"100/s", Rate{Count: 100, Per: time.Second}, "100/s"},
+		{"5/m", Rate{Count: 5, Per: time.Minute}, "5/m"},
+		{"10/100ms", Rate{Count: 10, Per: 100 * time.Millisecond}, "10/100ms"},
+		{"2/d", Rate{Count: 2, Per: 24 * time.Hour}, "2/d"},
+		{"3/24h", Rate{Count: 3, Per: 24 * time.Hour}, "3/d"},
+		{"9223372036854775807", ByteSize(math.MaxInt64), "9223372036854775807B"},
+		{"-9223372036854775808", ByteSize(math.MinInt64), "-8192PiB"},
+		{"8191PiB", 8191 * PiB, "8191PiB"},
+		{"90s", 90 * time.Second, "1m30s"},
+	}
+
+	for _, test := range tests {
+		result, err := parseValue(reflect.TypeOf(test.expected), test.input)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %v", test.input, err)
+			continue
+		}
+		if result.Interface() != test.expected {
+			t.Errorf("Expected %v, but got %v", test.expected, result.Interface())
+		}
+		if s := fmt.Sprint(result.Interface()); s != test.output {
+			t.Errorf("Expected %q, but got %q", test.output, s)
+		}
+	}
+
+	for _, input := range []string{"12XB", "abc", "5/fortnight", "5"} {
+		if _, err := ParseByteSize(input); err == nil && input != "5" {
+			t.Errorf("Expected error parsing byte size %q", input)
+		}
+		if _, err := ParseRate(input); err == nil {
+			t.Errorf("Expected error parsing rate %q", input)
+		}
+	}
+
+	for _, input := range []string{"9223372036854775808", "8192PiB", "8e18KB", "9.3e18"} {
+		if size, err := ParseByteSize(input); err == nil {
+			t.Errorf("Expected %q to be out of range, but got %d", input, int64(size))
+		}
+	}
+
+	var size ByteSize
+	if err := json.Unmarshal([]byte(`2048`), &size); err != nil || size != 2*KiB {
+		t.Errorf("Expected 2KiB from a JSON number, but got %v (%v)", size, err)
+	}
+	data, _ := json.Marshal(map[string]interface{}{"size": 512 * MiB, "load": Percent(75), "rate": Rate{Count: 100, Per: time.Second}})
+	if string(data) != `{"load":"75%","rate":"100/s","size":"512MiB"}` {
+		t.Errorf("Expected human readable JSON, but got %s", data)
+	}
+}
+
+type NetTestConfig struct {
+	Structure
+	Endpoint func() *url.URL            `json:"endpoint" help:"Test field"`
+	Bind     func() netip.Addr          `json:"bind" help:"Test field"`
+	Listen   func() netip.AddrPort      `json:"listen" help:"Test field"`
+	Allowed  func() []netip.Prefix      `json:"allowed" help:"Test field"`
+	Mirrors  func() []*url.URL          `json:"mirrors" help:"Test field"`
+	Backends func() []NetBackend        `json:"backends" help:"Test field"`
+	Links    func() map[string]*url.URL `json:"links" help:"Test field"`
+}
+
+type NetBackend struct {
+	Name string   `json:"name"`
+	URL  *url.URL `json:"url"`
+}
+
+func TestNetworkValues(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "net.json")
+	if err := os.WriteFile(filename, []byte(`{"endpoint":"https://api.example.com/v1","bind":"10.0.0.1","mirrors":["https://a.example.com","https://b.example.com"],"backends":[{"name":"a","url":"https://a.example.com"}],"links":{"docs":"https://docs.example.com"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("LISTEN", "[::1]:8443")
+	os.Setenv("ALLOWED", "10.0.0.0/8,192.168.0.0/16")
+	defer os.Unsetenv("LISTEN")
+	defer os.Unsetenv("ALLOWED")
+
+	config := &NetTestConfig{}
+	config.Init(config, WithFileConfig(filename))
+
+	if config.Endpoint() == nil || config.Endpoint().Host != "api.example.com" {
+		t.Errorf("Expected endpoint URL, but got %v", config.Endpoint())
+	}
+	if config.Bind() != netip.MustParseAddr("10.0.0.1") {
+		t.Errorf("Expected 10.0.0.1, but got %v", config.Bind())
+	}
+	if config.Listen() != netip.MustParseAddrPort("[::1]:8443") {
+		t.Errorf("Expected [::1]:8443, but got %v", config.Listen())
+	}
+	if len(config.Allowed()) != 2 || !config.Allowed()[1].Contains(netip.MustParseAddr("192.168.1.1")) {
+		t.Errorf("Expected two prefixes, but got %v", config.Allowed())
+	}
+	if len(config.Mirrors()) != 2 || config.Mirrors()[1].Host != "b.example.com" {
+		t.Errorf("Expected two mirrors, but got %v", config.Mirrors())
+	}
+
+	var saved map[string]interface{}
+	if err := json.Unmarshal(config.GetJSONBytes(), &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved["endpoint"] != "https://api.example.com/v1" || saved["listen"] != "[::1]:8443" {
+		t.Errorf("Expected values saved as strings, but got %v", saved)
+	}
+	if len(config.Backends()) != 1 || config.Backends()[0].URL.Host != "a.example.com" || config.Links()["docs"].Host != "docs.example.com" {
+		t.Errorf("Expected URLs in structs and maps, but got %v and %v", config.Backends(), config.Links())
+	}
+	backends, _ := json.Marshal(saved["backends"])
+	links, _ := json.Marshal(saved["links"])
+	if string(backends) != `[{"name":"a","url":"https://a.example.com"}]` || string(links) != `{"docs":"https://docs.example.com"}` {
+		t.Errorf("Expected nested URLs saved as strings, but got %s and %s", backends, links)
+	}
+
+	err := config.loadJSONConfigFromBytes([]byte(`{"bind":"10.0.0.300"}`))
+	if err == nil || !strings.Contains(err.Error(), "bind") {
+		t.Errorf("Expected error naming the key, but got %v", err)
+	}
+	err = config.loadJSONConfigFromBytes([]byte(`{"endpoint":"not a url"}`))
+	if err == nil || !strings.Contains(err.Error(), "endpoint") {
+		t.Errorf("Expected error naming the key, but got %v", err)
+	}
+}
+
+type SecretTestConfig struct {
+	Structure
+	User     func() string         `json:"user" help:"Test field"`
+	Password func() string         `json:"password" secret:"true" help:"Test field"`
+	Token    func() Secret[string] `json:"token" help:"Test field"`
+}
+
+func TestSecretValues(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "secret.json")
+	if err := os.WriteFile(filename, []byte(`{"user":"admin","password":"hunter2","token":"tok-123"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &SecretTestConfig{}
+	config.Init(config, WithFileConfig(filename), WithSkipEnvironment())
+
+	if config.Password() != "hunter2" || config.Token().Value() != "tok-123" {
+		t.Errorf("Expected real values from accessors, but got %v and %v", config.Password(), config.Token().Value())
+	}
+	views := map[string]string{
+		"String":       config.String(),
+		"GetJSONBytes": string(config.GetJSONBytes()),
+		"flag default": (&dynamicVar{config: &config.Structure, name: "password"}).String(),
+		"Sprint":       fmt.Sprint(config.Token()),
+	}
+	for view, text := range views {
+		if strings.Contains(text, "hunter2") || strings.Contains(text, "tok-123") {
+			t.Errorf("Expected secrets to be masked in %s, but got %s", view, text)
+		}
+	}
+	if !strings.Contains(views["String"], "admin") {
+		t.Errorf("Expected other values to be shown, but got %s", views["String"])
+	}
+
+	if err := config.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filename)
+	if !strings.Contains(string(data), "hunter2") || !strings.Contains(string(data), "tok-123") {
+		t.Errorf("Expected saved file to hold real values, but got %s", data)
+	}
+}
+
+type NestedSecretTestConfig struct {
+	Structure
+	Pin      func() Secret[int]     `json:"pin" help:"Test field"`
+	Accounts func() []SecretAccount `json:"accounts" help:"Test field"`
+}
+
+type SecretAccount struct {
+	Name string         `json:"name"`
+	Key  Secret[string] `json:"key"`
+}
+
+func TestNestedSecrets(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "secret.json")
+	if err := os.WriteFile(filename, []byte(`{"pin":1234,"accounts":[{"name":"ops","key":"key-456"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &NestedSecretTestConfig{}
+	config.Init(config, WithFileConfig(filename), WithSkipEnvironment())
+	if len(config.Accounts()) != 1 || config.Accounts()[0].Key.Value() != "key-456" || config.Pin().Value() != 1234 {
+		t.Errorf("Expected real values from accessors, but got %v and %v", config.Accounts(), config.Pin().Value())
+	}
+	if text := string(config.GetJSONBytes()); strings.Contains(text, "key-456") || strings.Contains(text, "1234") {
+		t.Errorf("Expected nested secrets to be masked, but got %s", text)
+	}
+
+	if err := config.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filename)
+	if !strings.Contains(string(data), `"key":"key-456"`) || !strings.Contains(string(data), `"pin":1234`) {
+		t.Errorf("Expected saved file to hold real values, but got %s", data)
+	}
+
+	errs := []error{
+		config.loadJSONConfigFromBytes([]byte(`{"pin":"xy9876"}`)),
+		(&dynamicVar{config: &config.Structure, name: "pin", want: reflect.TypeOf(Secret[int]{})}).Set("xy9876"),
+		(&dynamicVar{config: &config.Structure, name: "accounts", want: reflect.TypeOf([]SecretAccount{})}).Set(`[{"name":"x","key":[98]}]`),
+	}
+	for _, err := range errs {
+		if err == nil || strings.Contains(err.Error(), "98") {
+			t.Errorf("Expected an error without the secret value, but got %v", err)
+		}
+	}
+}
+
+type EncryptedTestConfig struct {
+	Structure
+	Password func() string `json:"password" secret:"true" help:"Test field"`
+	APIKey   func() string `json:"api_key" secret:"true" help:"Test field"`
+	Port     func() int    `json:"port" help:"Test field"`
+}
+
+func TestEncryptedValues(t *testing.T) {
+	kp := KeyProviderFunc(func() ([]byte, error) { return []byte("0123456789abcdef0123456789abcdef"), nil })
+	password, err := EncryptValue(kp, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := EncryptValue(kp, "5432")
+
+	filename := filepath.Join(t.TempDir(), "encrypted.json")
+	data, _ := json.Marshal(map[string]string{"password": password, "port": port, "api_key": "plain-key"})
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &EncryptedTestConfig{}
+	config.Init(config, WithFileConfig(filename), WithKeyProvider(kp), WithSkipEnvironment())
+	if config.Password() != "hunter2" || config.Port() != 5432 || config.APIKey() != "plain-key" {
+		t.Errorf("Expected decrypted values, but got %v, %v and %v", config.Password(), config.Port(), config.APIKey())
+	}
+
+	if err := config.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = os.ReadFile(filename)
+	var saved map[string]string
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("Expected all values to be saved encrypted, but got %s", data)
+	}
+	for key, value := range saved {
+		if plaintext, err := DecryptValue(kp, value); err != nil {
+			t.Errorf("Expected %s to be encrypted, but got %v (%v)", key, value, err)
+		} else if key == "api_key" && plaintext != "plain-key" {
+			t.Errorf("Expected 'plain-key', but got %v", plaintext)
+		}
+	}
+	if saved["password"] != password || saved["port"] != port {
+		t.Errorf("Expected unchanged values to keep their ciphertext, but got %v", saved)
+	}
+
+	wrongKey := KeyProviderFunc(func() ([]byte, error) { return []byte("fedcba9876543210fedcba9876543210"), nil })
+	other := &EncryptedTestConfig{}
+	other.Init(other, WithKeyProvider(wrongKey), WithSkipEnvironment())
+	err = other.loadJSONConfigFromBytes(data)
+	if err == nil || !strings.Contains(err.Error(), "cannot decrypt") {
+		t.Errorf("Expected decrypt error with the wrong key, but got %v", err)
+	}
+}
+
+func TestEncryptionKeyEnv(t *testing.T) {
+	t.Setenv(DefaultEncryptionKeyEnv, "0123456789abcdef0123456789abcdef")
+	filename := filepath.Join(t.TempDir(), "app.json")
+	if err := os.WriteFile(filename, []byte(`{"password": "hunter2", "port": 1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Secrets are encrypted with the same fallback key that decrypts them
+	config := &EncryptedTestConfig{}
+	config.Init(config, WithFileConfig(filename), WithSkipEnvironment(), WithSkipSaveOnExit())
+	if err := config.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filename)
+	if strings.Contains(string(data), "hunter2") || !strings.Contains(string(data), `"password": "enc:v1:`) {
+		t.Errorf("Expected the password to be saved encrypted, but got %s", data)
+	}
+
+	reloaded := &EncryptedTestConfig{}
+	reloaded.Init(reloaded, WithFileConfig(filename), WithSkipEnvironment(), WithSkipSaveOnExit())
+	if reloaded.Password() != "hunter2" || reloaded.Port() != 1 {
+		t.Errorf("Expected hunter2 and 1, but got %s and %d", reloaded.Password(), reloaded.Port())
+	}
+}
+
+func TestSecretRefs(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "db_password")
+	if err := os.WriteFile(secretFile, []byte("hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("TEST_API_KEY", "key-123")
+	defer os.Unsetenv("TEST_API_KEY")
+	RegisterSecretResolver("test", SecretResolverFunc(func(location string) (string, error) {
+		return location, nil
+	}))
+
+	filename := filepath.Join(dir, "refs.json")
+	document := `{"password":"ref+file://` + secretFile + `","api_key":"ref+env://TEST_API_KEY","port":"ref+test://8080"}`
+	if err := os.WriteFile(filename, []byte(document), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &EncryptedTestConfig{}
+	config.Init(config, WithFileConfig(filename), WithSkipEnvironment())
+	if config.Password() != "hunter2" || config.APIKey() != "key-123" || config.Port() != 8080 {
+		t.Errorf("Expected resolved secrets, but got %v, %v and %v", config.Password(), config.APIKey(), config.Port())
+	}
+
+	config.Set("password", "changed")
+	if err := config.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filename)
+	var saved map[string]interface{}
+	json.Unmarshal(data, &saved)
+	if saved["password"] != "changed" || saved["api_key"] != "ref+env://TEST_API_KEY" || saved["port"] != "ref+test://8080" {
+		t.Errorf("Expected references, and the value set in place of one, to be saved, but got %s", data)
+	}
+
+	if err := config.loadJSONConfigFromBytes([]byte(`{"port":"ref+test://abc"}`)); err == nil {
+		t.Errorf("Expected error for a reference resolving to an invalid int")
+	}
+	if err := config.loadJSONConfigFromBytes([]byte(`{"api_key":"ref+unknown://x"}`)); err == nil || !strings.Contains(err.Error(), "api_key") {
+		t.Errorf("Expected error naming the key, but got %v", err)
+	}
+}
+
+func TestAtomicSaveWithBackups(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "app.json")
+	if err := os.WriteFile(filename, []byte(`{"user":"v0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &SecretTestConfig{}
+	config.Init(config, WithFileConfig(filename), WithFileMode(0600), WithFileBackups(2), WithSkipEnvironment())
+	for _, user := range []string{"v1", "v2", "v3"} {
+		config.Set("user", user)
+		if err := config.Save(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for suffix, expected := range map[string]string{"": "v3", ".1": "v2", ".2": "v1"} {
+		data, err := os.ReadFile(filename + suffix)
+		if err != nil || !strings.Contains(string(data), `"user":"`+expected+`"`) {
+			t.Errorf("Expected %s in %s, but got %s (%v)", expected, filename+suffix, data, err)
+		}
+	}
+	if _, err := os.Stat(filename + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 backups to be kept")
+	}
+	if info, err := os.Stat(filename); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, but got %v (%v)", info.Mode().Perm(), err)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(filename))
+	if len(entries) != 3 {
+		t.Errorf("Expected no temporary files to be left, but got %v", entries)
+	}
+}
+
+func TestSavePreservesDocument(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "app.json")
+	original := "{\n\t// Owned by another service\n\t\"other_service\": {\"enabled\": true},\n\t\"user\": \"admin\", // the admin user\n\t\"password\": \"hunter2\"\n}\n"
+	if err := os.WriteFile(filename, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &SecretTestConfig{}
+	config.Init(config, WithFileConfig(filename), WithSkipEnvironment())
+	config.Set("user", "root")
+	if err := config.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "{\n\t// Owned by another service\n\t\"other_service\": {\"enabled\": true},\n\t\"user\": \"root\", // the admin user\n\t\"password\": \"hunter2\",\n\t\"token\": \"\"\n}\n"
+	data, _ := os.ReadFile(filename)
+	if string(data) != expected {
+		t.Errorf("Expected\n%s\nbut got\n%s", expected, data)
+	}
+}
+
+type FormatTestConfig struct {
+	Structure
+	Timeout  func() time.Duration `json:"timeout" help:"Test field"`
+	MaxSize  func() ByteSize      `json:"max_size" help:"Test field"`
+	Endpoint func() *url.URL      `json:"endpoint" help:"Test field"`
+	Name     func() string        `json:"name" help:"Test field"`
+}
+
+func TestSaveKeepsValueFormat(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "app.json")
+	original := `{"timeout": "5s", "max_size": 2048, "endpoint": "HTTP://Example.com/a", "name": "a"}`
+	if err := os.WriteFile(filename, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &FormatTestConfig{}
+	config.Init(config, WithFileConfig(filename), WithSkipEnvironment(), WithSkipSaveOnExit())
+	config.Set("name", "b")
+	if err := config.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"timeout": "5s", "max_size": 2048, "endpoint": "HTTP://Example.com/a", "name": "b"}`
+	if data, _ := os.ReadFile(filename); string(data) != expected {
+		t.Errorf("Expected only the name to be rewritten, but got %s", data)
+	}
+
+	config.Set("timeout", time.Minute)
+	if err := config.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filename); !strings.Contains(string(data), `"timeout": 60000000000`) {
+		t.Errorf("Expected the changed timeout to be rewritten, but got %s", data)
+	}
+}
+
+func TestSparseSave(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "app.json")
+	if err := os.WriteFile(filename, []byte(`{"port": 8080}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("API_KEY", "from-env")
+
+	config := &EncryptedTestConfig{}
+	config.Init(config, WithFileConfig(filename), WithSparseSave())
+	config.Set("password", "hunter2")
+
+	expected := map[string]Source{"port": SourceFile, "api_key": SourceEnv, "password": SourceSet, "missing": SourceDefault}
+	for key, source := range expected {
+		if got := config.Source(key); got != source {
+			t.Errorf("Expected source of %s to be %v, but got %v", key, source, got)
+		}
+	}
+
+	if err := config.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filename)
+	if string(data) != `{"port": 8080,"password":"hunter2"}` {
+		t.Errorf("Expected only file and Set keys to be saved, but got %s", data)
+	}
+}
+
+func TestSaveAndReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "app.json")
+	if err := os.WriteFile(filename, []byte(`{"port": 1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("API_KEY", "from-env")
+
+	config := &EncryptedTestConfig{}
+	config.Init(config, WithFileConfig(filename), WithSkipSaveOnExit())
+	if config.Port() != 1 {
+		t.Errorf("Expected port 1, but got %d", config.Port())
+	}
+
+	// Environment variables keep precedence over reloaded values
+	if err := os.WriteFile(filename, []byte(`{"port": 2, "api_key": "from-file"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if config.Port() != 2 || config.APIKey() != "from-env" {
+		t.Errorf("Expected port 2 and api_key from-env, but got %d and %s", config.Port(), config.APIKey())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := config.Save(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, but got %v", err)
+	}
+
+	config.Set("port", 3)
+	if err := config.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if config.changed {
+		t.Errorf("Expected changed to be cleared after saving")
+	}
+	config.Set("port", 4)
+	if err := config.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if config.Port() != 3 {
+		t.Errorf("Expected the saved port 3 after reloading, but got %d", config.Port())
+	}
+
+	// References and keys removed from the file are forgotten on reload
+	t.Setenv("TEST_RELOAD_PASSWORD", "from-ref")
+	if err := os.WriteFile(filename, []byte(`{"port": 7, "password": "ref+env://TEST_RELOAD_PASSWORD"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Reload(context.Background()); err != nil || config.Password() != "from-ref" {
+		t.Fatalf("Expected the resolved password, but got %s (%v)", config.Password(), err)
+	}
+	if err := os.WriteFile(filename, []byte(`{"password": "plain"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if config.Port() != 0 || config.Source("port") != SourceDefault || config.Password() != "plain" {
+		t.Errorf("Expected the default port and the plain password, but got %d (%v) and %s", config.Port(), config.Source("port"), config.Password())
+	}
+	config.Set("port", 8)
+	if err := config.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filename)
+	if !strings.Contains(string(data), `"password": "plain"`) {
+		t.Errorf("Expected the plain password to be kept, but got %s", data)
+	}
+}
+
+func TestExitFunc(t *testing.T) {
+	dir := t.TempDir()
+	var calls []string
+	withFunc := &EncryptedTestConfig{}
+	withFunc.Init(withFunc, WithFileConfig(filepath.Join(dir, "a.json")), WithSkipEnvironment(), WithSkipSaveOnExit(),
+		WithExitFunc(func() { calls = append(calls, "exit func") }))
+	withFunc.skipSaveOnExit = false // Saved by saveOnExit below, without the signal handler
+	withFunc.Set("port", 9)
+	without := &EncryptedTestConfig{}
+	without.Init(without, WithFileConfig(filepath.Join(dir, "b.json")), WithSkipEnvironment(), WithSkipSaveOnExit())
+	without.Set("port", 10)
+
+	exit := func() { calls = append(calls, "exit") }
+	saveOnExit([]*Structure{&withFunc.Structure}, exit)
+	if len(calls) != 1 || calls[0] != "exit func" {
+		t.Errorf("Expected only the exit function to be called, but got %v", calls)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "a.json")); !strings.Contains(string(data), `"port":9`) {
+		t.Errorf("Expected the config to be saved before the exit function, but got %s", data)
+	}
+
+	// Another config without an exit function still exits, and one skipping the save is left alone
+	calls = nil
+	saveOnExit([]*Structure{&withFunc.Structure, &without.Structure}, exit)
+	if len(calls) != 1 || calls[0] != "exit func" {
+		t.Errorf("Expected a config skipping the save to be left alone, but got %v", calls)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected a config skipping the save not to be saved, but got %v", err)
+	}
+	calls = nil
+	without.skipSaveOnExit = false
+	saveOnExit([]*Structure{&withFunc.Structure, &without.Structure}, exit)
+	if len(calls) != 2 || calls[0] != "exit func" || calls[1] != "exit" {
+		t.Errorf("Expected the exit function and then exit, but got %v", calls)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "b.json")); !strings.Contains(string(data), `"port":10`) {
+		t.Errorf("Expected the other config to be saved, but got %s", data)
+	}
+}
+
+func TestConcurrentSaves(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "app.json")
+	if err := os.WriteFile(filename, []byte(`{"port": 1, "password": "a", "api_key": "b"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	first := &EncryptedTestConfig{}
+	first.Init(first, WithFileConfig(filename), WithSkipEnvironment(), WithSkipSaveOnExit())
+	second := &EncryptedTestConfig{}
+	second.Init(second, WithFileConfig(filename), WithSkipEnvironment(), WithSkipSaveOnExit())
+
+	first.Set("port", 2)
+	if err := first.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Different keys are merged
+	second.Set("password", "x")
+	if err := second.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filename)
+	if string(data) != `{"port": 2, "password": "x", "api_key": "b"}` {
+		t.Errorf("Expected both changes to be saved, but got %s", data)
+	}
+	if second.Port() != 2 {
+		t.Errorf("Expected the merged port 2, but got %d", second.Port())
+	}
+
+	// The same key changed to different values is a conflict
+	first.Set("password", "y")
+	if err := first.Save(context.Background()); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict, but got %v", err)
+	}
+	data, _ = os.ReadFile(filename)
+	if string(data) != `{"port": 2, "password": "x", "api_key": "b"}` {
+		t.Errorf("Expected the file to be unchanged after a conflict, but got %s", data)
+	}
+
+	// Loading waits for a save holding the lock, and the last holder removes the .lock file
+	handler := &handlerFile{filename: filename}
+	unlock, err := handler.lock(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := make(chan []byte)
+	go func() {
+		data, _ := handler.LoadConfig(context.Background())
+		loaded <- data
+	}()
+	select {
+	case <-loaded:
+		t.Errorf("Expected loading to wait for the save")
+	case <-time.After(50 * time.Millisecond):
+	}
+	os.WriteFile(filename, []byte(`{"port": 3}`), 0644)
+	unlock()
+	if data := <-loaded; string(data) != `{"port": 3}` {
+		t.Errorf("Expected the saved file to be loaded, but got %s", data)
+	}
+	if _, err := os.Stat(filename + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("Expected the .lock file to be removed, but got %v", err)
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	config := &EncryptedTestConfig{}
+	config.Init(config, WithSkipEnvironment())
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			config.Get("port")
+		}
+	})
+}
+
+// BenchmarkGetWhileSetting reads one config while another is continually Set, which only
+// contend if they share a lock
+func BenchmarkGetWhileSetting(b *testing.B) {
+	writer := &EncryptedTestConfig{}
+	writer.Init(writer, WithSkipEnvironment())
+	reader := &EncryptedTestConfig{}
+	reader.Init(reader, WithSkipEnvironment())
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				writer.Set("port", i)
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			reader.Get("port")
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+func TestConcurrentSetAndSave(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "app.json")
+	if err := os.WriteFile(filename, []byte(`{"port": 1, "api_key": "a"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	first := &EncryptedTestConfig{}
+	first.Init(first, WithFileConfig(filename), WithSkipEnvironment(), WithSkipSaveOnExit())
+	second := &EncryptedTestConfig{}
+	second.Init(second, WithFileConfig(filename), WithSkipEnvironment(), WithSkipSaveOnExit())
+
+	// Each config changes its own key, so saves merge with the other's without conflicts
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				var err error
+				if i%2 == 0 {
+					first.Set("port", j)
+					err = first.Save(context.Background())
+				} else {
+					second.Set("api_key", fmt.Sprint(j))
+					err = second.Save(context.Background())
+				}
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "app.json")
+	if err := os.WriteFile(filename, []byte(`{"port": 1, "password": "a"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	kp := KeyProviderFunc(func() ([]byte, error) { return []byte("0123456789abcdef0123456789abcdef"), nil })
+	config := &EncryptedTestConfig{}
+	config.Init(config, WithFileConfig(filename), WithSkipEnvironment(), WithSkipSaveOnExit(), WithKeyProvider(kp))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := config.Save(context.Background()); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				config.Set("port", j)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := config.Reload(context.Background()); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if port := config.Port(); port < 0 || port >= 100 {
+					t.Errorf("Unexpected port %d", port)
+				}
+				config.Password()
+				config.Get("port")
+				// Printing flags masks secrets while values are set
+				if s := (&dynamicVar{config: &config.Structure, name: "password"}).String(); s != secretMask {
+					t.Errorf("Expected the password to be masked, but got %s", s)
+				}
+				if s := (&dynamicVar{config: &config.Structure, name: "port"}).String(); s == secretMask {
+					t.Errorf("Expected the port not to be masked")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allocs := testing.AllocsPerRun(100, func() { config.Port() }); allocs != 0 {
+		t.Errorf("Expected reading a value not to allocate, but got %v allocations", allocs)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	config := &EncryptedTestConfig{}
+	config.Init(config, WithSkipEnvironment())
+	var notified [][]string
+	config.OnChange(func(keys []string) {
+		notified = append(notified, keys)
+	})
+
+	err := config.Update(func(tx *Tx) error {
+		if err := tx.Set("password", "hunter2"); err != nil {
+			return err
+		}
+		if err := tx.Set("port", 8080); err != nil {
+			return err
+		}
+		if port, _ := tx.Get("port"); port != 8080 {
+			t.Errorf("Expected the staged port 8080, but got %v", port)
+		}
+		if config.Port() != 0 {
+			t.Errorf("Expected staged values not to be visible before the update is committed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Password() != "hunter2" || config.Port() != 8080 {
+		t.Errorf("Expected both values to be updated, but got %s and %d", config.Password(), config.Port())
+	}
+	if !reflect.DeepEqual(notified, [][]string{{"password", "port"}}) {
+		t.Errorf("Expected a single notification for both keys, but got %v", notified)
+	}
+
+	// Nothing is applied when the update fails
+	err = config.Update(func(tx *Tx) error {
+		tx.Set("password", "changed")
+		return tx.Set("port", "not a port")
+	})
+	if err == nil {
+		t.Errorf("Expected an error for a mistyped value")
+	}
+	if config.Password() != "hunter2" || len(notified) != 1 {
+		t.Errorf("Expected the failed update to be rolled back, but got %s", config.Password())
+	}
+
+	config.Set("port", 9090)
+	if !reflect.DeepEqual(notified[1], []string{"port"}) {
+		t.Errorf("Expected a notification for Set, but got %v", notified[1:])
+	}
+	config.Set("port", 9090)
+	config.Update(func(tx *Tx) error { return tx.Set("port", 9090) })
+	if len(notified) != 2 {
+		t.Errorf("Expected no notification for unchanged values, but got %v", notified[2:])
+	}
+
+	// Validators see the staged values together
+	validated := &EncryptedTestConfig{}
+	validated.Init(validated, WithSkipEnvironment(), WithValidator(func(s *Snapshot) error {
+		port, _ := s.Get("port")
+		password, _ := s.Get("password")
+		if port != 0 && password == "" {
+			return errors.New("a port needs a password")
+		}
+		return nil
+	}))
+	if err := validated.Set("port", 8080); err == nil || validated.Port() != 0 {
+		t.Errorf("Expected the validator to reject a port without a password, but got %v", err)
+	}
+	err = validated.Update(func(tx *Tx) error {
+		tx.Set("port", 8080)
+		return tx.Set("password", "hunter2")
+	})
+	if err != nil || validated.Port() != 8080 {
+		t.Errorf("Expected the port and password to be accepted together, but got %v", err)
+	}
+	if CompareAndSwap(&validated.Structure, "password", "hunter2", "") {
+		t.Errorf("Expected the validator to reject removing the password")
+	}
+}
+
+func TestTypedAccess(t *testing.T) {
+	config := &EncryptedTestConfig{}
+	config.Init(config, WithSkipEnvironment())
+
+	if err := SetTyped(&config.Structure, "port", 8080); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetTyped(&config.Structure, "port", int64(8080)); err == nil {
+		t.Errorf("Expected a type mismatch for an int64 port")
+	}
+	if port, err := GetTyped[int](&config.Structure, "port"); err != nil || port != 8080 {
+		t.Errorf("Expected port 8080, but got %d (%v)", port, err)
+	}
+	if _, err := GetTyped[string](&config.Structure, "port"); err == nil {
+		t.Errorf("Expected a type mismatch reading port as a string")
+	}
+	if _, err := GetTyped[int](&config.Structure, "missing"); err == nil {
+		t.Errorf("Expected an error for a missing key")
+	}
+
+	if CompareAndSwap(&config.Structure, "port", 1, 2) {
+		t.Errorf("Expected the swap to fail when the old value doesn't match")
+	}
+	if !CompareAndSwap(&config.Structure, "port", 8080, 9090) || config.Port() != 9090 {
+		t.Errorf("Expected the port to be swapped to 9090, but got %d", config.Port())
+	}
+
+	// Concurrent increments are never lost
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				for {
+					port, _ := GetTyped[int](&config.Structure, "port")
+					if CompareAndSwap(&config.Structure, "port", port, port+1) {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if config.Port() != 9190 {
+		t.Errorf("Expected port 9190 after 100 increments, but got %d", config.Port())
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	config := &RoutesTestConfig{}
+	config.Init(config, WithSkipEnvironment())
+	config.Set("routes", []testRoute{{Name: "api", Upstream: "http://api"}})
+
+	snapshot := config.Snapshot()
+	if snapshot.Source("routes") != SourceSet {
+		t.Errorf("Expected source set, but got %v", snapshot.Source("routes"))
+	}
+
+	config.Set("routes", []testRoute{{Name: "web", Upstream: "http://web"}})
+	config.Set("extra", "value")
+	if config.Snapshot().Version() <= snapshot.Version() {
+		t.Errorf("Expected the version to increase after changes")
+	}
+	routes, _ := snapshot.Get("routes")
+	routes.([]testRoute)[0].Name = "changed"
+	if routes, _ := snapshot.Get("routes"); routes.([]testRoute)[0].Name != "api" {
+		t.Errorf("Expected the snapshot not to change, but got %v", routes)
+	}
+
+	if err := config.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if routes := config.Routes(); len(routes) != 1 || routes[0].Name != "api" {
+		t.Errorf("Expected the api route to be restored, but got %v", routes)
+	}
+	if _, exists := config.Get("extra"); exists {
+		t.Errorf("Expected keys added after the snapshot to be removed")
+	}
+
+	config.changed = false
+	if err := config.Restore(config.Snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	if config.hasChanged() {
+		t.Errorf("Expected restoring the current values not to mark the config as changed")
+	}
+}
+
+func TestWithFlagSet(t *testing.T) {
+	resetCommandLine()
+	firstFlags := flag.NewFlagSet("first", flag.ContinueOnError)
+	first := &EncryptedTestConfig{}
+	first.Init(first, WithSkipEnvironment(), WithFlagSet(firstFlags))
+	if flag.Lookup("port") != nil {
+		t.Errorf("Expected flag.CommandLine to be left alone")
+	}
+	secondFlags := flag.NewFlagSet("second", flag.ContinueOnError)
+	second := &EncryptedTestConfig{}
+	second.Init(second, WithSkipEnvironment(), WithFlagSet(secondFlags), WithSkipFlagUsage())
+
+	if err := firstFlags.Parse([]string{"-port", "8080"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := secondFlags.Parse([]string{"-port", "9090"}); err != nil {
+		t.Fatal(err)
+	}
+	if first.Port() != 8080 || second.Port() != 9090 {
+		t.Errorf("Expected ports 8080 and 9090, but got %d and %d", first.Port(), second.Port())
+	}
+}
+
+func TestFlagUsage(t *testing.T) {
+	flags := flag.NewFlagSet("app", flag.ContinueOnError)
+	var out strings.Builder
+	flags.SetOutput(&out)
+	flags.Bool("v", false, "verbose output")
+
+	config := &NestedTestConfig{Name: DefaultValue("svc")}
+	config.Init(config, WithFlagSet(flags))
+	flags.Usage()
+
+	expected := `Usage of app:
+  -v	verbose output
+
+NestedTestConfig:
+  -name string
+    	Test field (default "svc", env NAME)
+
+NestedTestConfig (db):
+  -db.host string
+    	Test field (env DB_HOST)
+  -db.port int
+    	Test field (env DB_PORT)
+`
+	if out.String() != expected {
+		t.Errorf("Expected usage\n%s\nbut got\n%s", expected, out.String())
+	}
+}
+
+type BoolTestConfig struct {
+	Structure
+	Verbose func() bool `json:"verbose" help:"Test field"`
+	Debug   func() bool `json:"debug" help:"Test field"`
+}
+
+func TestBoolFlags(t *testing.T) {
+	flags := flag.NewFlagSet("app", flag.ContinueOnError)
+	config := &BoolTestConfig{Debug: DefaultValue(true)}
+	config.Init(config, WithSkipEnvironment(), WithFlagSet(flags))
+
+	if err := flags.Parse([]string{"-verbose", "-no-debug", "arg"}); err != nil {
+		t.Fatal(err)
+	}
+	if !config.Verbose() || config.Debug() {
+		t.Errorf("Expected verbose on and debug off, but got %v and %v", config.Verbose(), config.Debug())
+	}
+	if flags.Arg(0) != "arg" {
+		t.Errorf("Expected arg to be left as an argument, but got %v", flags.Args())
+	}
+	if err := flags.Parse([]string{"-verbose=ture"}); err == nil {
+		t.Errorf("Expected an error for an invalid boolean")
+	}
+
+	for input, expected := range map[string]bool{"on": true, "YES": true, "t": true, "off": false, "N": false, "": false} {
+		if b, err := parseBool(input); err != nil || b != expected {
+			t.Errorf("Expected %q to be %v, but got %v (%v)", input, expected, b, err)
+		}
+	}
+	if _, err := parseBool("enabled"); err == nil {
+		t.Errorf("Expected an error for enabled")
+	}
+}
+
+type POSIXTestConfig struct {
+	Structure
+	ListenAddr func() string `json:"listen_addr" short:"l" help:"Test field"`
+	Verbose    func() bool   `json:"verbose" short:"v" help:"Test field"`
+	Workers    func() int    `json:"workers" short:"w" help:"Test field"`
+	DB         struct {
+		Host func() string `json:"host" help:"Test field"`
+	} `json:"db"`
+}
+
+func TestPOSIXFlags(t *testing.T) {
+	flags := flag.NewFlagSet("app", flag.ContinueOnError)
+	var out strings.Builder
+	flags.SetOutput(&out)
+	config := &POSIXTestConfig{}
+	config.Init(config, WithSkipEnvironment(), WithFlagSet(flags), WithPOSIXFlags())
+
+	err := config.ParseFlags([]string{"-vw4", "--listen-addr", ":8080", "file1", "--db-host=db1", "--", "-x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.Verbose() || config.Workers() != 4 || config.ListenAddr() != ":8080" || config.DB.Host() != "db1" {
+		t.Errorf("Unexpected values %v %d %s %s", config.Verbose(), config.Workers(), config.ListenAddr(), config.DB.Host())
+	}
+	if !reflect.DeepEqual(config.Args(), []string{"file1", "-x"}) {
+		t.Errorf("Expected args [file1 -x], but got %v", config.Args())
+	}
+
+	if err := config.ParseFlags([]string{"--no-verbose", "-l:9090"}); err != nil || config.Verbose() || config.ListenAddr() != ":9090" {
+		t.Errorf("Expected verbose off and :9090, but got %v and %s (%v)", config.Verbose(), config.ListenAddr(), err)
+	}
+	for _, args := range [][]string{{"--unknown"}, {"-x"}, {"-l"}, {"--workers=many"}} {
+		if err := config.ParseFlags(args); err == nil {
+			t.Errorf("Expected an error parsing %v", args)
+		}
+	}
+
+	if err := config.ParseFlags([]string{"--help"}); err != flag.ErrHelp {
+		t.Errorf("Expected flag.ErrHelp, but got %v", err)
+	}
+	if !strings.Contains(out.String(), "  -l, --listen-addr string\n") || !strings.Contains(out.String(), "  -v, --verbose, --no-verbose\n") {
+		t.Errorf("Unexpected usage\n%s", out.String())
+	}
+
+	for key, expected := range map[string]string{"listen_addr": "listen-addr", "listenAddr": "listen-addr", "APIKey": "api-key", "db.max_conns": "db-max-conns"} {
+		if name := kebabCase(key); name != expected {
+			t.Errorf("Expected %s to be %s, but got %s", key, expected, name)
+		}
+	}
+}
+
+func TestConfigAndSetFlags(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "a.json"), filepath.Join(dir, "b.json")
+	os.WriteFile(first, []byte(`{"name": "a", "db": {"port": 1}}`), 0644)
+	os.WriteFile(second, []byte(`{"name": "b", "db": {"host": "b-host"}}`), 0644)
+
+	flags := flag.NewFlagSet("app", flag.ContinueOnError)
+	config := &NestedTestConfig{}
+	config.Init(config, WithFileConfig(first), WithSkipEnvironment(), WithSkipSaveOnExit(), WithFlagSet(flags), WithConfigFlag(), WithSetFlag())
+	if config.DB.Port() != 1 {
+		t.Fatalf("Expected port 1 from the first file, but got %d", config.DB.Port())
+	}
+
+	// Flags keep precedence over the file, whatever their order
+	if err := flags.Parse([]string{"-set", "db.host=flag-host", "-config", second}); err != nil {
+		t.Fatal(err)
+	}
+	if config.Name() != "b" || config.DB.Host() != "flag-host" || config.DB.Port() != 0 {
+		t.Errorf("Expected b, flag-host and 0, but got %s, %s and %d", config.Name(), config.DB.Host(), config.DB.Port())
+	}
+	if config.Source("name") != SourceFile || config.Source("db.host") != SourceFlag {
+		t.Errorf("Unexpected sources %v and %v", config.Source("name"), config.Source("db.host"))
+	}
+
+	// A config without a file is registered to be saved on exit once, however often it switches
+	otherFlags := flag.NewFlagSet("other", flag.ContinueOnError)
+	other := &NestedTestConfig{}
+	other.Init(other, WithSkipEnvironment(), WithFlagSet(otherFlags), WithConfigFlag())
+	if err := otherFlags.Parse([]string{"-config", first, "-config", second}); err != nil {
+		t.Fatal(err)
+	}
+	if other.Name() != "b" || other.DB.Port() != 0 {
+		t.Errorf("Expected b and 0, but got %s and %d", other.Name(), other.DB.Port())
+	}
+	registered := 0
+	configsMutex.Lock()
+	for _, c := range configsToSave {
+		if c == &other.Structure {
+			registered++
+		}
+	}
+	configsMutex.Unlock()
+	if registered != 1 {
+		t.Errorf("Expected the config to be registered once, but got %d", registered)
+	}
+
+	routesFlags := flag.NewFlagSet("routes", flag.ContinueOnError)
+	routes := &RoutesTestConfig{}
+	routes.Init(routes, WithSkipEnvironment(), WithFlagSet(routesFlags), WithSetFlag())
+	err := routesFlags.Parse([]string{"-set", "backends.primary.host=10.0.0.1", "-set", "routes.0.name=api", "-set", "backends.primary.max_conns=5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backend := routes.Backends()["primary"]; backend.Host != "10.0.0.1" || backend.MaxConns != 5 {
+		t.Errorf("Expected the primary backend to be set, but got %v", routes.Backends())
+	}
+	if len(routes.Routes()) != 1 || routes.Routes()[0].Name != "api" {
+		t.Errorf("Expected the api route to be set, but got %v", routes.Routes())
+	}
+	if err := routesFlags.Parse([]string{"-set", "unknown=1"}); err == nil {
+		t.Errorf("Expected an error setting an unknown key")
+	}
+}
+
+type CompletionTestConfig struct {
+	Structure
+	Mode    func() string `json:"mode" oneof:"fast slow" help:"Run mode"`
+	Cert    func() string `json:"cert" path:"true" help:"Certificate file"`
+	Data    func() string `json:"data" path:"dir" help:"Data directory"`
+	Verbose func() bool   `json:"verbose" help:"Verbose output"`
+}
+
+func TestCompletionScripts(t *testing.T) {
+	flags := flag.NewFlagSet("app", flag.ContinueOnError)
+	var out strings.Builder
+	flags.SetOutput(&out)
+	config := &CompletionTestConfig{}
+	config.Init(config, WithSkipEnvironment(), WithFlagSet(flags), WithCompletionFlag())
+
+	expected := map[string][]string{
+		"bash": {
+			`-mode) COMPREPLY=($(compgen -W 'fast slow' -- "$cur")); return ;;`,
+			`-cert) COMPREPLY=($(compgen -f -- "$cur")); return ;;`,
+			`-data) COMPREPLY=($(compgen -d -- "$cur")); return ;;`,
+			`compgen -W '-mode -cert -data -verbose -no-verbose'`,
+			`complete -o default -F _app_completion app`,
+		},
+		"zsh": {
+			`'-mode[Run mode]:mode:(fast slow)'`,
+			`'-cert[Certificate file]:cert:_files'`,
+			`'-data[Data directory]:data:_files -/'`,
+			`'-verbose[Verbose output]'`,
+		},
+		"fish": {
+			`complete -c app -o mode -d 'Run mode' -x -a 'fast slow'`,
+			`complete -c app -o cert -d 'Certificate file' -r -F`,
+			`complete -c app -o verbose -d 'Verbose output'` + "\n",
+		},
+	}
+	for shell, lines := range expected {
+		script, err := config.CompletionScript(shell)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range lines {
+			if !strings.Contains(script, line) {
+				t.Errorf("Expected the %s script to contain %s, but got\n%s", shell, line, script)
+			}
+		}
+	}
+	if _, err := config.CompletionScript("powershell"); err == nil {
+		t.Errorf("Expected an error for an unsupported shell")
+	}
+
+	// The flag leaves printing the script and exiting to the app
+	if config.Completion() != "" {
+		t.Errorf("Expected no completion script before the flag is given")
+	}
+	if err := flags.Parse([]string{"-completion", "fish"}); err != nil {
+		t.Fatal(err)
+	}
+	if script, _ := config.CompletionScript("fish"); config.Completion() != script {
+		t.Errorf("Expected the fish script, but got\n%s", config.Completion())
+	}
+	if err := flags.Parse([]string{"-completion", "powershell"}); err == nil {
+		t.Errorf("Expected an error asking for an unsupported shell")
+	}
+	out.Reset()
+
+	// The oneof tag is enforced, not just completed
+	if err := config.Set("mode", "medium"); err == nil || config.Mode() != "" {
+		t.Errorf("Expected an error setting mode to medium, but got %v and %s", err, config.Mode())
+	}
+	if err := config.Set("mode", "slow"); err != nil || config.Mode() != "slow" {
+		t.Errorf("Expected mode slow, but got %s (%v)", config.Mode(), err)
+	}
+	if err := config.Update(func(tx *Tx) error { return tx.Set("mode", "medium") }); err == nil || config.Mode() != "slow" {
+		t.Errorf("Expected an error staging mode medium, but got %v and %s", err, config.Mode())
+	}
+	if CompareAndSwap(&config.Structure, "mode", "slow", "medium") || config.Mode() != "slow" {
+		t.Errorf("Expected CompareAndSwap to refuse medium, but got %s", config.Mode())
+	}
+	if err := flags.Parse([]string{"-mode", "medium"}); err == nil || config.Mode() != "slow" {
+		t.Errorf("Expected an error parsing -mode medium, but got %v and %s", err, config.Mode())
+	}
+	out.Reset()
+
+	flags.Usage()
+	if strings.Contains(out.String(), "completion") || !strings.Contains(out.String(), "Run mode (one of fast, slow)") {
+		t.Errorf("Expected a hidden completion flag and the mode's values in the usage, but got\n%s", out.String())
+	}
+}
+
+func TestDefaultErrorWrapper(t *testing.T) {
+	if err := defaultErrorWrapper(os.ErrNotExist, 0, ""); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the error itself without a message, but got %v", err)
+	}
+	if err := defaultErrorWrapper(os.ErrNotExist, 400, "bad key %s", "port"); err == nil || err.Error() != "bad key port" {
+		t.Errorf("Expected the formatted message, but got %v", err)
+	}
+	if err := defaultErrorWrapper(nil, 400, "bad key %s", "port"); err == nil || err.Error() != "bad key port" {
+		t.Errorf("Expected the formatted message, but got %v", err)
+	}
+}
+
+func TestDecodeKey(t *testing.T) {
+	raw := []byte("0123456789abcdef0123456789abcdef")
+	tests := map[string][]byte{
+		string(raw):                            raw,
+		string(raw) + "\n":                     raw,
+		hex.EncodeToString(raw):                raw,
+		base64.StdEncoding.EncodeToString(raw): raw,
+		hex.EncodeToString(raw[:24]) + "\n":    raw[:24],
+		"0123456789abcdef":                     []byte("0123456789abcdef"),
+	}
+	for input, expected := range tests {
+		key, err := decodeKey([]byte(input))
+		if err != nil || string(key) != string(expected) {
+			t.Errorf("Expected %q from %q, but got %q (%v)", expected, input, key, err)
+		}
+	}
+	for _, input := range []string{"short", strings.Repeat("z", 64), strings.Repeat("!", 44)} {
+		if _, err := decodeKey([]byte(input)); err == nil {
+			t.Errorf("Expected an error decoding %q", input)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package cfggo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// configSection is an object in the config document, holding the values of a (nested) struct.
+// It is a distinct type so sections can be told apart from map values when patching.
+type configSection map[string]interface{}
+
+// jsonObject is the position of an object, and its members, in a JSON document
+type jsonObject struct {
+	start   int // Offset of '{'
+	end     int // Offset of '}'
+	members []jsonMember
+}
+
+type jsonMember struct {
+	key        string
+	valueStart int
+	valueEnd   int
+}
+
+// jsonEdit replaces data[start:end] with text
+type jsonEdit struct {
+	start, end int
+	text       []byte
+}
+
+// patchJSONDocument merges section into the JSON document data, changing only the values that
+// differ and adding missing keys. Keys that are not in section, key order, formatting and
+// comments are kept as they are.
+func patchJSONDocument(data []byte, section configSection) ([]byte, error) {
+	start := skipJSONSpace(data, 0)
+	if start >= len(data) || data[start] != '{' {
+		return nil, fmt.Errorf("config document is not a JSON object")
+	}
+	root, err := parseJSONObject(data, start)
+	if err != nil {
+		return nil, err
+	}
+
+	indent := "  "
+	if len(root.members) > 0 {
+		if memberIndent := lineIndent(data, root.members[0].valueStart); memberIndent != "" {
+			indent = memberIndent
+		}
+	}
+
+	pretty := bytes.IndexByte(data[root.start:root.end], '\n') >= 0
+	edits, err := patchJSONObject(data, root, section, indent, pretty)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+	out := append([]byte(nil), data...)
+	for _, edit := range edits {
+		out = append(out[:edit.start], append(edit.text, out[edit.end:]...)...)
+	}
+	return out, nil
+}
+
+// patchJSONObject returns the edits that merge section into obj. Values and new keys are
+// formatted like the object's existing members, pretty is used for empty objects.
+func patchJSONObject(data []byte, obj jsonObject, section configSection, indent string, pretty bool) ([]jsonEdit, error) {
+	multiline := bytes.IndexByte(data[obj.start:obj.end], '\n') >= 0 || len(obj.members) == 0 && pretty
+	memberIndent := lineIndent(data, obj.start) + indent
+	if len(obj.members) > 0 {
+		memberIndent = lineIndent(data, obj.members[0].valueStart)
+	}
+
+	members := make(map[string]jsonMember, len(obj.members))
+	for _, member := range obj.members {
+		members[member.key] = member
+	}
+
+	keys := make([]string, 0, len(section))
+	for key := range section {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var edits []jsonEdit
+	var added []string
+	for _, key := range keys {
+		value := section[key]
+		member, exists := members[key]
+		if !exists {
+			text, err := marshalJSONMember(key, value, multiline, memberIndent, indent)
+			if err != nil {
+				return nil, err
+			}
+			added = append(added, text)
+			continue
+		}
+
+		raw := data[member.valueStart:member.valueEnd]
+		if nested, ok := value.(configSection); ok && raw[0] == '{' {
+			obj, err := parseJSONObject(data, member.valueStart)
+			if err != nil {
+				return nil, err
+			}
+			nestedEdits, err := patchJSONObject(data, obj, nested, indent, pretty)
+			if err != nil {
+				return nil, err
+			}
+			edits = append(edits, nestedEdits...)
+			continue
+		}
+		if equal, err := jsonValueEqual(raw, value); err != nil {
+			return nil, err
+		} else if equal {
+			continue
+		}
+		text, err := marshalJSONValue(value, multiline, memberIndent, indent)
+		if err != nil {
+			return nil, err
+		}
+		edits = append(edits, jsonEdit{start: member.valueStart, end: member.valueEnd, text: text})
+	}
+
+	if len(added) == 0 {
+		return edits, nil
+	}
+	if len(obj.members) == 0 {
+		// Empty objects are laid out like the rest of the document
+		inner := data[obj.start+1 : obj.end]
+		if !pretty {
+			return append(edits, jsonEdit{start: obj.start + 1, end: obj.start + 1, text: []byte(strings.Join(added, ","))}), nil
+		}
+		text := "\n" + memberIndent + strings.Join(added, ",\n"+memberIndent)
+		if len(bytes.TrimSpace(inner)) == 0 {
+			return append(edits, jsonEdit{start: obj.start + 1, end: obj.end, text: []byte(text + "\n" + lineIndent(data, obj.start))}), nil
+		}
+		return append(edits, jsonEdit{start: obj.start + 1, end: obj.start + 1, text: []byte(text)}), nil
+	}
+
+	last := obj.members[len(obj.members)-1]
+	pos := last.valueEnd
+	if multiline {
+		// Keep a comment on the same line as the last value with that value
+		lineEnd := skipJSONLineComment(data, pos)
+		text := "\n" + memberIndent + strings.Join(added, ",\n"+memberIndent)
+		if lineEnd == pos {
+			return append(edits, jsonEdit{start: pos, end: pos, text: []byte("," + text)}), nil
+		}
+		edits = append(edits, jsonEdit{start: pos, end: pos, text: []byte(",")})
+		return append(edits, jsonEdit{start: lineEnd, end: lineEnd, text: []byte(text)}), nil
+	}
+	return append(edits, jsonEdit{start: pos, end: pos, text: []byte("," + strings.Join(added, ","))}), nil
+}
+
+// marshalJSONMember returns "key": value, formatted to match the surrounding object
+func marshalJSONMember(key string, value interface{}, multiline bool, memberIndent, indent string) (string, error) {
+	name, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	text, err := marshalJSONValue(value, multiline, memberIndent, indent)
+	if err != nil {
+		return "", err
+	}
+	if multiline {
+		return string(name) + ": " + string(text), nil
+	}
+	return string(name) + ":" + string(text), nil
+}
+
+func marshalJSONValue(value interface{}, multiline bool, memberIndent, indent string) ([]byte, error) {
+	if multiline {
+		return json.MarshalIndent(value, memberIndent, indent)
+	}
+	return json.Marshal(value)
+}
+
+// jsonValueEqual reports whether the JSON value raw holds the same data as value
+func jsonValueEqual(raw []byte, value interface{}) (bool, error) {
+	var existing interface{}
+	if err := json.Unmarshal(stripJSONComments(raw), &existing); err != nil {
+		return false, err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+	var updated interface{}
+	if err := json.Unmarshal(data, &updated); err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(existing, updated), nil
+}
+
+// parseJSONObject records the members of the object starting at data[start]
+func parseJSONObject(data []byte, start int) (jsonObject, error) {
+	obj := jsonObject{start: start}
+	i := start + 1
+	for {
+		i = skipJSONSpace(data, i)
+		if i >= len(data) {
+			return obj, fmt.Errorf("unexpected end of JSON document")
+		}
+		if data[i] == '}' {
+			obj.end = i
+			return obj, nil
+		}
+		if data[i] != '"' {
+			return obj, fmt.Errorf("expected object key at offset %d", i)
+		}
+		keyEnd, err := scanJSONValue(data, i)
+		if err != nil {
+			return obj, err
+		}
+		var key string
+		if err := json.Unmarshal(data[i:keyEnd], &key); err != nil {
+			return obj, err
+		}
+		i = skipJSONSpace(data, keyEnd)
+		if i >= len(data) || data[i] != ':' {
+			return obj, fmt.Errorf("expected ':' at offset %d", i)
+		}
+		valueStart := skipJSONSpace(data, i+1)
+		valueEnd, err := scanJSONValue(data, valueStart)
+		if err != nil {
+			return obj, err
+		}
+		obj.members = append(obj.members, jsonMember{key: key, valueStart: valueStart, valueEnd: valueEnd})
+		i = skipJSONSpace(data, valueEnd)
+		if i < len(data) && data[i] == ',' {
+			i++
+		}
+	}
+}
+
+// scanJSONValue returns the offset just past the JSON value starting at data[i]
+func scanJSONValue(data []byte, i int) (int, error) {
+	if i >= len(data) {
+		return i, fmt.Errorf("unexpected end of JSON document")
+	}
+	switch data[i] {
+	case '{':
+		obj, err := parseJSONObject(data, i)
+		if err != nil {
+			return i, err
+		}
+		return obj.end + 1, nil
+	case '[':
+		i++
+		for {
+			i = skipJSONSpace(data, i)
+			if i >= len(data) {
+				return i, fmt.Errorf("unexpected end of JSON document")
+			}
+			if data[i] == ']' {
+				return i + 1, nil
+			}
+			end, err := scanJSONValue(data, i)
+			if err != nil {
+				return i, err
+			}
+			i = skipJSONSpace(data, end)
+			if i < len(data) && data[i] == ',' {
+				i++
+			}
+		}
+	case '"':
+		for i++; i < len(data); i++ {
+			switch data[i] {
+			case '\\':
+				i++
+			case '"':
+				return i + 1, nil
+			}
+		}
+		return i, fmt.Errorf("unterminated string in JSON document")
+	}
+	start := i
+	for i < len(data) && !strings.ContainsRune(",}] \t\r\n/", rune(data[i])) {
+		i++
+	}
+	if i == start {
+		return i, fmt.Errorf("unexpected %q at offset %d", data[i], i)
+	}
+	return i, nil
+}
+
+// skipJSONSpace returns the offset of the next character in data that isn't whitespace or
+// part of a // or /* */ comment
+func skipJSONSpace(data []byte, i int) int {
+	for i < len(data) {
+		switch {
+		case data[i] == ' ' || data[i] == '\t' || data[i] == '\r' || data[i] == '\n':
+			i++
+		case bytes.HasPrefix(data[i:], []byte("//")):
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case bytes.HasPrefix(data[i:], []byte("/*")):
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				return len(data)
+			}
+			i += end + 4
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// skipJSONLineComment returns the offset of the end of the line at i, if the rest of it is only
+// whitespace and comments, otherwise i
+func skipJSONLineComment(data []byte, i int) int {
+	j := i
+	for j < len(data) {
+		switch {
+		case data[j] == ' ' || data[j] == '\t':
+			j++
+		case bytes.HasPrefix(data[j:], []byte("/*")):
+			end := bytes.Index(data[j+2:], []byte("*/"))
+			if end < 0 || bytes.IndexByte(data[j:j+end+2], '\n') >= 0 {
+				return i
+			}
+			j += end + 4
+		case bytes.HasPrefix(data[j:], []byte("//")):
+			for j < len(data) && data[j] != '\n' && data[j] != '\r' {
+				j++
+			}
+			return j
+		case data[j] == '\n' || data[j] == '\r':
+			return j
+		default:
+			return i
+		}
+	}
+	return j
+}
+
+// lineIndent returns the whitespace at the start of the line holding data[pos]
+func lineIndent(data []byte, pos int) string {
+	start := bytes.LastIndexByte(data[:pos], '\n') + 1
+	end := start
+	for end < pos && (data[end] == ' ' || data[end] == '\t') {
+		end++
+	}
+	return string(data[start:end])
+}
+
+// stripJSONComments replaces // and /* */ comments with spaces, so documents with comments can
+// be decoded by encoding/json. Offsets, and so error positions, are unchanged.
+func stripJSONComments(data []byte) []byte {
+	if bytes.IndexByte(data, '/') < 0 {
+		return data
+	}
+	out := append([]byte(nil), data...)
+	for i := 0; i < len(out); i++ {
+		switch {
+		case out[i] == '"':
+			for i++; i < len(out) && out[i] != '"'; i++ {
+				if out[i] == '\\' {
+					i++
+				}
+			}
+		case bytes.HasPrefix(out[i:], []byte("//")):
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+		case bytes.HasPrefix(out[i:], []byte("/*")):
+			end := bytes.Index(out[i+2:], []byte("*/"))
+			if end < 0 {
+				end = len(out)
+			} else {
+				end += i + 4
+			}
+			for ; i < end; i++ {
+				if out[i] != '\n' {
+					out[i] = ' '
+				}
+			}
+			i--
+		}
+	}
+	return out
+}
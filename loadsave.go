@@ -1,8 +1,12 @@
 package cfggo
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"os/signal"
 	"reflect"
@@ -12,81 +16,547 @@ import (
 )
 
 var configsToSave []*Structure
+var configsMutex sync.Mutex
 var once sync.Once
 
-func (c *Structure) loadConfig() error {
-	if c.configHandler == nil {
+// Save writes the configuration to its config file or HTTP destination
+func (c *Structure) Save(ctx context.Context) error {
+	return c.saveConfig(ctx)
+}
+
+// Reload loads the configuration again from its config file or HTTP source. Values from
+// environment variables and flags keep precedence over the reloaded values, and keys removed
+// from the file go back to their defaults.
+func (c *Structure) Reload(ctx context.Context) error {
+	return c.loadConfig(ctx)
+}
+
+// SaveAll saves every changed configuration, for use in a shutdown sequence when the automatic
+// save on exit is disabled with WithSkipSaveOnExit
+func SaveAll(ctx context.Context) error {
+	configsMutex.Lock()
+	configs := append([]*Structure(nil), configsToSave...)
+	configsMutex.Unlock()
+
+	var errs []error
+	for _, config := range configs {
+		if config.hasChanged() {
+			if err := config.saveConfig(ctx); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// hasChanged reports whether values were changed since the config was last saved
+func (c *Structure) hasChanged() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.changed
+}
+
+func (c *Structure) loadConfig(ctx context.Context) error {
+	handler := c.handler()
+	if handler == nil {
 		return ErrorWrapper(nil, 400, "configSource is nil")
 	}
 
-	data, err := c.configHandler.LoadConfig()
+	data, err := handler.LoadConfig(ctx)
 	if err != nil {
 		return ErrorWrapper(err, 0, "")
 	}
 
-	// if c.configHandler.SaveConfig != nil {
-	// 	// Logger.Debug("Setting up config saver")
-	// }
-	c.setupConfigSaver()
-
+	c.mu.Lock()
+	c.document = data // Kept so saving can merge into it
+	c.mu.Unlock()
 	return c.loadJSONConfigFromBytes(data)
 }
 
+// setFileEncoding records the ciphertext and secret reference key was loaded from, if any,
+// without locking
+func (c *Structure) setFileEncoding(key string, ciphertext string, ref string) {
+	delete(c.encryptedKeys, key)
+	delete(c.secretRefs, key)
+	if ciphertext != "" {
+		if c.encryptedKeys == nil {
+			c.encryptedKeys = make(map[string]string)
+		}
+		c.encryptedKeys[key] = ciphertext
+	}
+	if ref != "" {
+		if c.secretRefs == nil {
+			c.secretRefs = make(map[string]string)
+		}
+		c.secretRefs[key] = ref
+	}
+}
+
+// resetFileValue sets key, loaded from the config file, back to its default, without locking.
+// It reports whether the value changed.
+func (c *Structure) resetFileValue(key string) bool {
+	isChange := c.valueChanged(key, c.defaults[key])
+	c.set(key, c.defaults[key])
+	delete(c.sources, key)
+	c.setFileEncoding(key, "", "")
+	return isChange
+}
+
+// resetFileValues sets every key loaded from the config file back to its default, and forgets
+// the loaded document, without locking
+func (c *Structure) resetFileValues() {
+	for key, source := range c.sources {
+		if source == SourceFile {
+			c.resetFileValue(key)
+		}
+	}
+	c.document = nil
+	c.encryptedKeys = nil
+	c.secretRefs = nil
+}
+
 func (c *Structure) loadJSONConfigFromBytes(data []byte) error {
-	tempConfigData := c.createStruct()
-	if err := json.Unmarshal(data, tempConfigData); err != nil {
+	var document map[string]json.RawMessage
+	if err := json.Unmarshal(stripJSONComments(data), &document); err != nil {
 		return ErrorWrapper(err, 0, "")
 	}
 
-	rvalue := reflect.ValueOf(tempConfigData).Elem()
-	rtype := rvalue.Type()
+	c.mu.Lock()
+	var loadErr error
+	var changed []string
+	c.walkConfigFields(reflect.ValueOf(c.parent), nil, func(path []string, field reflect.StructField, fieldValue reflect.Value) {
+		configKey := strings.Join(path, ".")
+		if source := c.sources[configKey]; source == SourceEnv || source == SourceFlag {
+			return // Takes precedence over the file when reloading
+		}
+		raw, ok := lookupJSONPath(document, path)
+		if !ok {
+			// Removed from the file since it was loaded
+			if c.sources[configKey] == SourceFile && c.resetFileValue(configKey) {
+				changed = append(changed, configKey)
+			}
+			return
+		}
+		var ciphertext, ref string
+		if isEncryptedValue(raw) {
+			json.Unmarshal(raw, &ciphertext)
+			plaintext, err := c.decryptRaw(raw)
+			if err != nil {
+				if loadErr == nil {
+					loadErr = ErrorWrapper(err, 400, "cannot decrypt value for key %s: %v", configKey, err)
+				}
+				return
+			}
+			raw = plaintext
+		}
+		if r, ok := secretRef(raw); ok {
+			resolved, err := ResolveSecretRef(r)
+			if err != nil {
+				if loadErr == nil {
+					loadErr = ErrorWrapper(err, 400, "cannot resolve %s for key %s: %v", r, configKey, err)
+				}
+				return
+			}
+			ref = r
+			raw, _ = json.Marshal(resolved)
+		}
+		value, err := decodeJSONValue(configValueType(field.Type), raw)
+		if err != nil {
+			if ref != "" {
+				err = errSecretValue
+			}
+			if loadErr == nil {
+				loadErr = ErrorWrapper(err, 400, "invalid value for key %s: %v", configKey, c.maskError(configKey, err))
+			}
+			return
+		}
+		if err := c.validateValue(configKey, value.Interface()); err != nil {
+			if loadErr == nil {
+				loadErr = err
+			}
+			return
+		}
+		isChange := c.valueChanged(configKey, value.Interface())
+		err = c.set(configKey, value.Interface())
+		if err != nil {
+			display := c.displayValue(configKey, value.Interface())
+			if ref != "" {
+				display = secretMask // Not published as a secret yet
+			}
+			Logger.Warn("loadConfig error setting %s to (%v): %v", configKey, display, err)
+			return
+		}
+		c.setSource(configKey, SourceFile)
+		c.setFileEncoding(configKey, ciphertext, ref)
+		if isChange {
+			changed = append(changed, configKey)
+		}
+	})
+	c.publish()
+	listeners := c.listeners
+	c.mu.Unlock()
+
+	notifyChange(listeners, changed)
+	return loadErr
+}
 
-	configMutex.Lock()
-	defer configMutex.Unlock()
-	for i := 0; i < rvalue.NumField(); i++ {
-		field := rtype.Field(i)
-		configKey := c.getConfigNameFromField(field)
-		if configKey == "" || configKey == "-" {
-			continue
+// decodeJSONValue decodes raw into a value of type want. Strings that don't decode as want
+// directly are parsed the way environment variables are, so "5s" works for a time.Duration.
+func decodeJSONValue(want reflect.Type, raw json.RawMessage) (reflect.Value, error) {
+	value := reflect.New(want)
+	err := json.Unmarshal(raw, value.Interface())
+	if err == nil {
+		return value.Elem(), nil
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		parsed, parseErr := parseValue(want, s)
+		if parseErr != nil {
+			return value.Elem(), parseErr
 		}
-		err := c.set(configKey, rvalue.Field(i).Interface())
+		return parsed, nil
+	}
+
+	// Decode elements one at a time, so each gets the same treatment
+	switch want.Kind() {
+	case reflect.Ptr:
+		if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+			return value.Elem(), nil
+		}
+		elem, err := decodeJSONValue(want.Elem(), raw)
 		if err != nil {
-			Logger.Warn("loadConfig error setting %s to (%v): %v", configKey, rvalue.Field(i).Interface(), err)
+			return value.Elem(), err
+		}
+		ptr := reflect.New(want.Elem())
+		ptr.Elem().Set(elem)
+		return ptr, nil
+	case reflect.Struct:
+		// Fields holding URLs are decoded on their own, as they are written as strings
+		var fields map[string]json.RawMessage
+		if !needsEncoding(want, nil) || json.Unmarshal(raw, &fields) != nil {
+			return value.Elem(), err
+		}
+		decoded := map[int]reflect.Value{}
+		for i := 0; i < want.NumField(); i++ {
+			name, ok := jsonFieldName(want.Field(i))
+			if !ok || !needsEncoding(want.Field(i).Type, nil) {
+				continue
+			}
+			for key, fieldRaw := range fields {
+				if strings.EqualFold(key, name) {
+					v, err := decodeJSONValue(want.Field(i).Type, fieldRaw)
+					if err != nil {
+						return value.Elem(), err
+					}
+					decoded[i] = v
+					delete(fields, key)
+				}
+			}
+		}
+		rest, _ := json.Marshal(fields)
+		if err := json.Unmarshal(rest, value.Interface()); err != nil {
+			return value.Elem(), err
+		}
+		for i, v := range decoded {
+			value.Elem().Field(i).Set(v)
 		}
+		return value.Elem(), nil
+	case reflect.Slice:
+		var elems []json.RawMessage
+		if json.Unmarshal(raw, &elems) != nil {
+			return value.Elem(), err
+		}
+		slice := reflect.MakeSlice(want, len(elems), len(elems))
+		for i, elem := range elems {
+			v, err := decodeJSONValue(want.Elem(), elem)
+			if err != nil {
+				return value.Elem(), err
+			}
+			slice.Index(i).Set(v)
+		}
+		return slice, nil
+	case reflect.Map:
+		var elems map[string]json.RawMessage
+		if want.Key().Kind() != reflect.String || json.Unmarshal(raw, &elems) != nil {
+			return value.Elem(), err
+		}
+		m := reflect.MakeMapWithSize(want, len(elems))
+		for k, elem := range elems {
+			v, err := decodeJSONValue(want.Elem(), elem)
+			if err != nil {
+				return value.Elem(), err
+			}
+			m.SetMapIndex(reflect.ValueOf(k).Convert(want.Key()), v)
+		}
+		return m, nil
 	}
+	return value.Elem(), err
+}
 
-	return nil
+// encodeJSONValue returns value in a form that marshals the way it is parsed, which only
+// differs from the value itself for URLs and, when unmask is set, Secrets, including those held
+// in slices, maps and structs. Secrets marshal as the mask unless unmasked, which is only done
+// for saving.
+func encodeJSONValue(value interface{}, unmask bool) interface{} {
+	if value == nil || !needsEncoding(reflect.TypeOf(value), nil) {
+		return value
+	}
+	return encodeValue(reflect.ValueOf(value), unmask)
+}
+
+var (
+	urlType         = reflect.TypeOf(url.URL{})
+	secretValueType = reflect.TypeOf((*secretValue)(nil)).Elem()
+)
+
+// needsEncoding reports whether values of type t hold a url.URL or a Secret anywhere
+func needsEncoding(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if t == urlType || t.Implements(secretValueType) {
+		return true
+	}
+	if seen[t] {
+		return false
+	}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		if seen == nil {
+			seen = make(map[reflect.Type]bool)
+		}
+		seen[t] = true
+		return needsEncoding(t.Elem(), seen)
+	case reflect.Struct:
+		if seen == nil {
+			seen = make(map[reflect.Type]bool)
+		}
+		seen[t] = true
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).IsExported() && needsEncoding(t.Field(i).Type, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// encodeValue returns v with every URL in it replaced by its string, and every Secret by its
+// value if unmask is set
+func encodeValue(v reflect.Value, unmask bool) interface{} {
+	t := v.Type()
+	switch {
+	case t == urlType:
+		u := v.Interface().(url.URL)
+		return u.String()
+	case !needsEncoding(t, nil):
+		return v.Interface()
+	case t.Kind() == reflect.Ptr || t.Kind() == reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return encodeValue(v.Elem(), unmask)
+	case t.Implements(secretValueType):
+		if !unmask {
+			return v.Interface()
+		}
+		return encodeJSONValue(v.Interface().(secretValue).secret(), unmask)
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		elems := make([]interface{}, v.Len())
+		for i := range elems {
+			elems[i] = encodeValue(v.Index(i), unmask)
+		}
+		return elems
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		m := reflect.MakeMapWithSize(reflect.MapOf(t.Key(), reflect.TypeOf((*interface{})(nil)).Elem()), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			elem := reflect.ValueOf(encodeValue(iter.Value(), unmask))
+			if !elem.IsValid() {
+				elem = reflect.Zero(m.Type().Elem())
+			}
+			m.SetMapIndex(iter.Key(), elem)
+		}
+		return m.Interface()
+	case reflect.Struct:
+		// Marshal the struct as usual, then replace the fields that need encoding
+		data, err := json.Marshal(v.Interface())
+		if err != nil {
+			return v.Interface()
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return v.Interface()
+		}
+		for i := 0; i < t.NumField(); i++ {
+			name, ok := jsonFieldName(t.Field(i))
+			if _, present := fields[name]; ok && present && needsEncoding(t.Field(i).Type, nil) {
+				fields[name] = encodeValue(v.Field(i), unmask)
+			}
+		}
+		return fields
+	}
+	return v.Interface()
 }
 
+// jsonFieldName returns the name encoding/json uses for a struct field, and false for fields
+// it skips or flattens
+func jsonFieldName(field reflect.StructField) (string, bool) {
+	if !field.IsExported() || field.Anonymous {
+		return "", false
+	}
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" {
+		return "", false
+	}
+	if name == "" {
+		name = field.Name
+	}
+	return name, true
+}
+
+// lookupJSONPath descends through nested JSON objects following path
+func lookupJSONPath(document map[string]json.RawMessage, path []string) (json.RawMessage, bool) {
+	raw, ok := document[path[0]]
+	if !ok || len(path) == 1 {
+		return raw, ok
+	}
+	var nested map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &nested); err != nil {
+		return nil, false
+	}
+	return lookupJSONPath(nested, path[1:])
+}
+
+// configDocument returns the config data laid out the way it is stored, with the values of
+// nested structs placed in nested objects. Only keys accepted by include are added, and each
+// value is passed through transform, if given.
+func (c *Structure) configDocument(include func(key string) bool, transform func(key string, value interface{}) (interface{}, error)) (configSection, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	document := make(configSection, len(c.configData))
+	seen := make(map[string]bool, len(c.configData))
+	var docErr error
+	c.walkConfigFields(reflect.ValueOf(c.parent), nil, func(path []string, field reflect.StructField, fieldValue reflect.Value) {
+		configKey := strings.Join(path, ".")
+		value, exists := c.configData[configKey]
+		if !exists || include != nil && !include(configKey) {
+			return
+		}
+		seen[configKey] = true
+		if transform != nil {
+			var err error
+			if value, err = transform(configKey, value); err != nil {
+				if docErr == nil {
+					docErr = err
+				}
+				return
+			}
+		}
+		parent := document
+		for _, name := range path[:len(path)-1] {
+			nested, ok := parent[name].(configSection)
+			if !ok {
+				nested = make(configSection)
+				parent[name] = nested
+			}
+			parent = nested
+		}
+		parent[path[len(path)-1]] = value
+	})
+	// Keys added with Set that have no matching struct field
+	for key, value := range c.configData {
+		if !seen[key] && (include == nil || include(key)) {
+			if transform != nil {
+				var err error
+				if value, err = transform(key, value); err != nil {
+					return nil, err
+				}
+			}
+			document[key] = value
+		}
+	}
+	return document, docErr
+}
+
+// setupConfigSaver registers c to be saved on exit, a config is only registered once
 func (c *Structure) setupConfigSaver() {
+	configsMutex.Lock()
+	for _, config := range configsToSave {
+		if config == c {
+			configsMutex.Unlock()
+			return
+		}
+	}
 	configsToSave = append(configsToSave, c)
+	configsMutex.Unlock()
+	if c.skipSaveOnExit {
+		return
+	}
 
 	once.Do(func() {
 		sigchan := make(chan os.Signal, 1)
 		signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM)
 		go func() {
 			<-sigchan
-			for _, config := range configsToSave {
-				if config.changed {
-					Logger.Info("Saving config before exit...")
-					if err := config.saveConfig(); err != nil {
-						Logger.Error("Error saving configuration: %v", err)
-					}
-				}
-			}
-			os.Exit(0)
+			// Later signals get their default behaviour, or go to the app's own handler
+			signal.Stop(sigchan)
+			configsMutex.Lock()
+			configs := append([]*Structure(nil), configsToSave...)
+			configsMutex.Unlock()
+			saveOnExit(configs, func() { os.Exit(0) })
 		}()
 	})
 }
 
+// saveOnExit saves the changed configs on SIGINT or SIGTERM and calls their exit functions. A
+// config's exit function only replaces exiting for that config, so exit is still called if any
+// of the configs has none.
+func saveOnExit(configs []*Structure, exit func()) {
+	var exitFuncs []func()
+	shouldExit := false
+	for _, config := range configs {
+		if config.skipSaveOnExit {
+			continue
+		}
+		if config.hasChanged() {
+			Logger.Info("Saving config before exit...")
+			if err := config.saveConfig(context.Background()); err != nil {
+				Logger.Error("Error saving configuration: %v", err)
+			}
+		}
+		if config.exitFunc != nil {
+			exitFuncs = append(exitFuncs, config.exitFunc)
+		} else {
+			shouldExit = true
+		}
+	}
+	for _, exitFunc := range exitFuncs {
+		exitFunc()
+	}
+	if shouldExit {
+		exit()
+	}
+}
+
 func (c *Structure) GetJSONBytes() []byte {
-	data, _ := json.Marshal(c.configData)
+	document, _ := c.configDocument(nil, func(key string, value interface{}) (interface{}, error) {
+		return encodeJSONValue(c.displayValue(key, value), false), nil
+	})
+	data, _ := json.Marshal(document)
 	return data
 }
 
 func (c *Structure) String() string {
 	var sb strings.Builder
 	sb.WriteString(c.name + ":\n")
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	maxKeyLen := 0
 	maxValueLen := 0
 	values := make(map[string]string, len(c.configData))
@@ -95,7 +565,7 @@ func (c *Structure) String() string {
 		if len(key) > maxKeyLen {
 			maxKeyLen = len(key)
 		}
-		valueStr := fmt.Sprintf("%v", value)
+		valueStr := fmt.Sprintf("%v", c.displayValue(key, value))
 		values[key] = valueStr
 		if len(valueStr) > maxValueLen {
 			maxValueLen = len(valueStr)
@@ -115,37 +585,127 @@ func (c *Structure) String() string {
 }
 
 func (c *Structure) GetHelpTag(key string) string {
-	v := reflect.ValueOf(c.parent)
-	for v.Kind() == reflect.Ptr {
-		v = v.Elem()
+	helpTag := ""
+	c.walkConfigFields(reflect.ValueOf(c.parent), nil, func(path []string, field reflect.StructField, fieldValue reflect.Value) {
+		if strings.Join(path, ".") == key {
+			helpTag = field.Tag.Get("help")
+		}
+	})
+	return helpTag
+}
+
+// handler returns the current config handler, which --config can replace at any time
+func (c *Structure) handler() configHandler {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.configHandler
+}
+
+func (c *Structure) saveConfig(ctx context.Context) error {
+	handler := c.handler()
+	if handler == nil {
+		return nil
 	}
-	if v.Kind() != reflect.Struct {
-		return ""
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+
+	var include func(key string) bool
+	if c.sparseSave {
+		// Defaults, and values from the environment or flags, stay out of the file
+		include = func(key string) bool {
+			return c.sources[key] == SourceFile || c.sources[key] == SourceSet
+		}
 	}
-	t := v.Type()
-	for i := 0; i < v.NumField(); i++ {
-		field := t.Field(i)
-		configVarName := c.getConfigNameFromField(field)
-		if configVarName == key {
-			return field.Tag.Get("help")
+	encrypted := make(map[string]string)
+	var loadedValues map[string]json.RawMessage
+	document, err := c.configDocument(include, func(key string, value interface{}) (interface{}, error) {
+		if loadedValues == nil {
+			// Decoded once, c.mu is held by configDocument
+			loadedValues = make(map[string]json.RawMessage)
+			json.Unmarshal(stripJSONComments(c.document), &loadedValues)
 		}
+		return c.prepareForSave(key, value, loadedValues, encrypted)
+	})
+	if err != nil {
+		return ErrorWrapper(err, 0, "")
 	}
-	return ""
-}
 
-func (c *Structure) saveConfig() error {
-	if c.configHandler == nil {
+	c.mu.RLock()
+	loaded := c.document
+	sources := make(map[string]Source, len(c.sources))
+	for key, source := range c.sources {
+		sources[key] = source
+	}
+	c.mu.RUnlock()
+
+	updater, ok := handler.(configUpdater)
+	if !ok {
+		data, err := c.renderDocument(loaded, document)
+		if err != nil {
+			return err
+		}
+		if err := handler.SaveConfig(ctx, data); err != nil {
+			return ErrorWrapper(err, 0, "")
+		}
+		c.saved(data, encrypted)
 		return nil
 	}
 
-	data, err := json.Marshal(c.configData)
+	var data []byte
+	merged := false
+	err = updater.UpdateConfig(ctx, func(current []byte) ([]byte, error) {
+		base := loaded
+		if current != nil && !bytes.Equal(current, base) {
+			// Changed by another process since it was loaded, keep its changes unless we changed the same keys
+			if err := mergeDocument(base, current, document, sources); err != nil {
+				return nil, err
+			}
+			base, merged = current, true
+		}
+		data, err = c.renderDocument(base, document)
+		return data, err
+	})
 	if err != nil {
 		return ErrorWrapper(err, 0, "")
 	}
+	c.saved(data, encrypted)
+	if merged {
+		// Pick up the other process's changes
+		if err := c.loadJSONConfigFromBytes(data); err != nil {
+			Logger.Warn("saveConfig: error loading the merged %s config: %v", c.name, err)
+		}
+	}
+	return nil
+}
 
-	if err := c.configHandler.SaveConfig(data); err != nil {
-		return ErrorWrapper(err, 0, "")
+// saved records data as the saved config document, and the ciphertexts of the values that were
+// saved encrypted
+func (c *Structure) saved(data []byte, encrypted map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.document = data
+	c.changed = false
+	for key, ciphertext := range encrypted {
+		if c.encryptedKeys == nil {
+			c.encryptedKeys = make(map[string]string)
+		}
+		c.encryptedKeys[key] = ciphertext
 	}
+}
 
-	return nil
+// renderDocument returns the config file contents for document, merged into base if given
+func (c *Structure) renderDocument(base []byte, document configSection) ([]byte, error) {
+	if len(base) > 0 {
+		// Merge into the loaded document, keeping keys this struct doesn't know about
+		data, err := patchJSONDocument(base, document)
+		if err == nil {
+			return data, nil
+		}
+		Logger.Warn("saveConfig: cannot merge into the loaded %s config, replacing it: %v", c.name, err)
+	}
+	data, err := json.Marshal(document)
+	if err != nil {
+		return nil, ErrorWrapper(err, 0, "")
+	}
+	return data, nil
 }
@@ -0,0 +1,19 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd || illumos)
+
+package cfggo
+
+import "os"
+
+// lockFile is a no-op on platforms without flock, where saves are still atomic but concurrent
+// savers aren't serialized
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
+
+func tryLockFile(f *os.File) bool {
+	return true
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
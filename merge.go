@@ -0,0 +1,80 @@
+package cfggo
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// ErrConflict is returned when saving a config file that another process changed since it was
+// loaded, and both changed the same key to different values
+var ErrConflict = errors.New("config file changed on disk")
+
+// mergeDocument is a three-way merge of document, the values about to be saved, with theirs,
+// the config file as another process saved it, using base, the file as it was loaded. Keys
+// whose value hasn't changed since base are removed from document, so the other process's
+// values are kept. Keys both sides changed, to different values, are a conflict. Sources are
+// those of the values in document, taken when it was built.
+func mergeDocument(base, theirs []byte, document configSection, sources map[string]Source) error {
+	var baseValues, theirValues map[string]json.RawMessage
+	if len(base) > 0 {
+		if err := json.Unmarshal(stripJSONComments(base), &baseValues); err != nil {
+			return err
+		}
+	}
+	if err := json.Unmarshal(stripJSONComments(theirs), &theirValues); err != nil {
+		return err
+	}
+	return mergeSection(nil, baseValues, theirValues, document, sources)
+}
+
+func mergeSection(prefix []string, base, theirs map[string]json.RawMessage, section configSection, sources map[string]Source) error {
+	for key, value := range section {
+		path := append(append([]string(nil), prefix...), key)
+		baseRaw, inBase := base[key]
+		theirRaw, inTheirs := theirs[key]
+
+		if nested, ok := value.(configSection); ok {
+			var baseNested, theirNested map[string]json.RawMessage
+			json.Unmarshal(baseRaw, &baseNested)
+			json.Unmarshal(theirRaw, &theirNested)
+			if err := mergeSection(path, baseNested, theirNested, nested, sources); err != nil {
+				return err
+			}
+			continue
+		}
+
+		configKey := strings.Join(path, ".")
+		ours := sources[configKey] != SourceDefault
+		if inBase {
+			equal, err := jsonValueEqual(baseRaw, value)
+			if err != nil {
+				return err
+			}
+			ours = !equal
+		}
+		if !ours {
+			if inTheirs {
+				delete(section, key)
+			}
+			continue
+		}
+		if !inTheirs {
+			continue
+		}
+		theirsChanged := true
+		if inBase {
+			equal, err := jsonValueEqual(theirRaw, baseRaw)
+			if err != nil {
+				return err
+			}
+			theirsChanged = !equal
+		}
+		if equal, err := jsonValueEqual(theirRaw, value); err != nil {
+			return err
+		} else if theirsChanged && !equal {
+			return ErrorWrapper(ErrConflict, 409, "%w: %s was changed by another process", ErrConflict, configKey)
+		}
+	}
+	return nil
+}
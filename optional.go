@@ -0,0 +1,79 @@
+package cfggo
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Optional holds a config value that may be left unset, so "not configured" can be told apart
+// from the zero value. It is unset by null in JSON files and by an empty environment variable or flag.
+type Optional[T any] struct {
+	value T
+	set   bool
+}
+
+// Some returns an Optional holding v
+func Some[T any](v T) Optional[T] {
+	return Optional[T]{value: v, set: true}
+}
+
+// Get returns the value and whether it is set
+func (o Optional[T]) Get() (T, bool) {
+	return o.value, o.set
+}
+
+// IsSet reports whether a value is set
+func (o Optional[T]) IsSet() bool {
+	return o.set
+}
+
+// OrElse returns the value if set, otherwise def
+func (o Optional[T]) OrElse(def T) T {
+	if !o.set {
+		return def
+	}
+	return o.value
+}
+
+func (o Optional[T]) String() string {
+	if !o.set {
+		return ""
+	}
+	return fmt.Sprint(o.value)
+}
+
+func (o Optional[T]) MarshalJSON() ([]byte, error) {
+	if !o.set {
+		return []byte("null"), nil
+	}
+	return json.Marshal(o.value)
+}
+
+func (o *Optional[T]) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*o = Optional[T]{}
+		return nil
+	}
+	var value T
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	*o = Some(value)
+	return nil
+}
+
+func (o *Optional[T]) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*o = Optional[T]{}
+		return nil
+	}
+	var value T
+	parsed, err := parseValue(reflect.TypeOf(&value).Elem(), string(text))
+	if err != nil {
+		return err
+	}
+	reflect.ValueOf(&value).Elem().Set(parsed)
+	*o = Some(value)
+	return nil
+}
@@ -1,6 +1,7 @@
 package cfggo
 
 import (
+	"flag"
 	"net/http"
 	"os"
 )
@@ -31,6 +32,31 @@ func WithFileConfig(filename string) Option {
 	}
 }
 
+// WithFileMode sets the file mode used when saving the config file, it must follow WithFileConfig
+func WithFileMode(mode os.FileMode) Option {
+	return func(c *Structure) error {
+		handler, ok := c.configHandler.(*handlerFile)
+		if !ok {
+			return ErrorWrapper(nil, 400, "WithFileMode requires WithFileConfig")
+		}
+		handler.mode = mode
+		return nil
+	}
+}
+
+// WithFileBackups keeps the previous n versions of the config file when saving, as
+// filename.1 (the newest) to filename.n, it must follow WithFileConfig
+func WithFileBackups(n int) Option {
+	return func(c *Structure) error {
+		handler, ok := c.configHandler.(*handlerFile)
+		if !ok {
+			return ErrorWrapper(nil, 400, "WithFileBackups requires WithFileConfig")
+		}
+		handler.backups = n
+		return nil
+	}
+}
+
 // WithHTTPConfig sets the config source/dest to a filename
 func WithHTTPConfig(httpLoader *http.Request, httpSaver *http.Request) Option {
 	if httpLoader == nil && httpSaver == nil {
@@ -62,3 +88,118 @@ func WithSkipEnvironment() Option {
 		return nil
 	}
 }
+
+// WithSparseSave only saves keys that were loaded from the config file or changed with Set, so
+// defaults aren't written out and newer defaults take effect after an upgrade
+func WithSparseSave() Option {
+	return func(c *Structure) error {
+		c.sparseSave = true
+		return nil
+	}
+}
+
+// WithSkipSaveOnExit doesn't save the config when the process receives SIGINT or SIGTERM, so it
+// can be saved with Save or SaveAll as part of the application's own shutdown
+func WithSkipSaveOnExit() Option {
+	return func(c *Structure) error {
+		c.skipSaveOnExit = true
+		return nil
+	}
+}
+
+// WithValidator adds a function that checks the config as a whole, eg. that a minimum is below a
+// maximum. It is given the values a Set, Update or CompareAndSwap would leave, and the change is
+// rejected if it returns an error.
+func WithValidator(fn func(s *Snapshot) error) Option {
+	return func(c *Structure) error {
+		c.validators = append(c.validators, fn)
+		return nil
+	}
+}
+
+// WithExitFunc calls fn, instead of exiting the process, after the config is saved on SIGINT or
+// SIGTERM, so it can start the application's own shutdown. It only applies to this config, the
+// process still exits if another config saved on exit has no exit function.
+func WithExitFunc(fn func()) Option {
+	return func(c *Structure) error {
+		c.exitFunc = fn
+		return nil
+	}
+}
+
+// WithFlagSet adds the config flags to flags instead of flag.CommandLine, so they can be parsed
+// separately, eg. by a library or a CLI framework
+func WithFlagSet(flags *flag.FlagSet) Option {
+	return func(c *Structure) error {
+		if flags == nil {
+			return ErrorWrapper(nil, 400, "WithFlagSet flag set is nil")
+		}
+		c.flagSet = flags
+		return nil
+	}
+}
+
+// WithSkipFlagUsage leaves the usage function of the flag set (flag.Usage by default) alone, which
+// then also lists the --completion flag
+func WithSkipFlagUsage() Option {
+	return func(c *Structure) error {
+		c.skipFlagUsage = true
+		return nil
+	}
+}
+
+// WithPOSIXFlags uses GNU style flags, parsed with ParseFlags, instead of the flag package. Keys
+// become kebab-case long flags, eg. --listen-addr, and a short tag adds a short flag, eg. -l.
+func WithPOSIXFlags() Option {
+	return func(c *Structure) error {
+		c.posix = &posixFlags{}
+		return nil
+	}
+}
+
+// WithConfigFlag adds a --config flag, which loads the config from another file than the one
+// given with WithFileConfig
+func WithConfigFlag() Option {
+	return func(c *Structure) error {
+		c.configFlag = true
+		return nil
+	}
+}
+
+// WithSetFlag adds a repeatable --set key=value flag, which sets any key, including nested keys
+// and the elements of slices and maps
+func WithSetFlag() Option {
+	return func(c *Structure) error {
+		c.setFlag = true
+		return nil
+	}
+}
+
+// WithCompletionFlag adds a hidden --completion flag, which asks for a bash, zsh or fish completion
+// script for the config flags, returned by Completion once the flags are parsed. It is only hidden
+// by the usage cfggo prints, so it is listed by flag.PrintDefaults and with WithSkipFlagUsage.
+func WithCompletionFlag() Option {
+	return func(c *Structure) error {
+		c.completion = true
+		return nil
+	}
+}
+
+// WithKeyProvider sets the key used to decrypt "enc:v1:" values when loading, and to encrypt
+// secret values when saving
+func WithKeyProvider(kp KeyProvider) Option {
+	return func(c *Structure) error {
+		c.keyProvider = kp
+		return nil
+	}
+}
+
+// WithEncryptionKeyEnv reads the encryption key from the environment variable name
+func WithEncryptionKeyEnv(name string) Option {
+	return WithKeyProvider(EnvKeyProvider(name))
+}
+
+// WithEncryptionKeyFile reads the encryption key from filename
+func WithEncryptionKeyFile(filename string) Option {
+	return WithKeyProvider(FileKeyProvider(filename))
+}
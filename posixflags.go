@@ -0,0 +1,228 @@
+package cfggo
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// posixFlags holds the flags of a config parsed GNU style, with WithPOSIXFlags
+type posixFlags struct {
+	long   map[string]*dynamicVar // By long name, eg. listen-addr
+	short  map[rune]*dynamicVar
+	names  map[string]string     // Long names by key
+	shorts map[string]rune       // Short names by key
+	extra  map[string]*flag.Flag // The --config, --set and --completion flags, when enabled
+	args   []string              // Arguments left after parsing
+}
+
+// createPOSIXFlags adds a kebab-case long flag for every key, and a short flag for keys
+// with a short tag
+func (c *Structure) createPOSIXFlags() {
+	p := c.posix
+	p.long = make(map[string]*dynamicVar)
+	p.short = make(map[rune]*dynamicVar)
+	p.names = make(map[string]string)
+	p.shorts = make(map[string]rune)
+	p.extra = c.builtinFlags()
+	c.walkConfigFields(reflect.ValueOf(c.parent), nil, func(path []string, field reflect.StructField, fieldValue reflect.Value) {
+		key := strings.Join(path, ".")
+		dv := &dynamicVar{config: c, name: key, want: reflect.TypeOf(c.configData[key]), source: SourceFlag}
+
+		name := kebabCase(key)
+		if _, exists := p.long[name]; exists || p.extra[name] != nil {
+			Logger.Error("Flag %s is already set, skipping...\n", name)
+			return
+		}
+		p.long[name] = dv
+		p.names[key] = name
+
+		if short := field.Tag.Get("short"); short != "" {
+			r, size := utf8.DecodeRuneInString(short)
+			if size != len(short) || r == '-' {
+				Logger.Error("Invalid short flag %s for %s, skipping...\n", short, key)
+				return
+			}
+			if _, exists := p.short[r]; exists {
+				Logger.Error("Flag %s is already set, skipping...\n", short)
+				return
+			}
+			p.short[r] = dv
+			p.shorts[key] = r
+		}
+	})
+}
+
+// kebabCase returns the long flag name for a config key, eg. listen_addr, listenAddr and
+// listen.addr all become listen-addr
+func kebabCase(key string) string {
+	runes := []rune(key)
+	var b strings.Builder
+	for i, r := range runes {
+		switch {
+		case r == '_' || r == '.' || r == ' ':
+			b.WriteByte('-')
+		case unicode.IsUpper(r):
+			// A new word starts after a lower case letter, or at the last capital of an acronym
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				unicode.IsUpper(runes[i-1]) && i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				b.WriteByte('-')
+			}
+			b.WriteRune(unicode.ToLower(r))
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// ParseFlags parses GNU style flags from args, usually os.Args[1:], when WithPOSIXFlags is used.
+// Long flags are written --listen-addr value or --listen-addr=value, short flags -l value, -lvalue
+// or combined, eg. -vl value. Bool flags take no value and long ones can be negated with --no-.
+// Arguments that aren't flags, and everything after --, are returned by Args.
+func (c *Structure) ParseFlags(args []string) error {
+	p := c.posix
+	if p == nil {
+		return ErrorWrapper(nil, 400, "ParseFlags requires WithPOSIXFlags")
+	}
+	p.args = nil
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			p.args = append(p.args, args[i+1:]...)
+			return nil
+
+		case strings.HasPrefix(arg, "--"):
+			name, value, hasValue := strings.Cut(arg[2:], "=")
+			dv, negated := p.long[name], false
+			if dv == nil && strings.HasPrefix(name, "no-") {
+				if dv = p.long[strings.TrimPrefix(name, "no-")]; dv != nil && dv.IsBoolFlag() {
+					negated = true
+				} else {
+					dv = nil
+				}
+			}
+			if f := p.extra[name]; dv == nil && f != nil {
+				if !hasValue {
+					if i+1 >= len(args) {
+						return ErrorWrapper(nil, 400, "flag --%s needs an argument", name)
+					}
+					i++
+					value = args[i]
+				}
+				if err := f.Value.Set(value); err != nil {
+					return ErrorWrapper(err, 400, "invalid value for flag --%s: %v", name, err)
+				}
+				continue
+			}
+			if dv == nil {
+				if name == "help" {
+					c.printPOSIXUsage()
+					return flag.ErrHelp
+				}
+				return ErrorWrapper(nil, 400, "unknown flag --%s", name)
+			}
+			if !hasValue {
+				if dv.IsBoolFlag() {
+					value = "true"
+				} else if i+1 < len(args) {
+					i++
+					value = args[i]
+				} else {
+					return ErrorWrapper(nil, 400, "flag --%s needs an argument", name)
+				}
+			}
+			var err error
+			if negated {
+				err = (&negatedVar{dv}).Set(value)
+			} else {
+				err = dv.Set(value)
+			}
+			if err != nil {
+				return ErrorWrapper(err, 400, "invalid value %q for flag --%s: %v", c.displayValue(dv.name, value), name, err)
+			}
+
+		case strings.HasPrefix(arg, "-") && arg != "-":
+			shorts := arg[1:]
+			for len(shorts) > 0 {
+				r, size := utf8.DecodeRuneInString(shorts)
+				shorts = shorts[size:]
+				dv := p.short[r]
+				if dv == nil {
+					if r == 'h' {
+						c.printPOSIXUsage()
+						return flag.ErrHelp
+					}
+					return ErrorWrapper(nil, 400, "unknown flag -%c", r)
+				}
+				if dv.IsBoolFlag() {
+					if err := dv.Set("true"); err != nil {
+						return ErrorWrapper(err, 400, "invalid value for flag -%c: %v", r, err)
+					}
+					continue
+				}
+				// The rest of the argument, or the next one, is the value
+				value := strings.TrimPrefix(shorts, "=")
+				if shorts == "" {
+					if i+1 >= len(args) {
+						return ErrorWrapper(nil, 400, "flag -%c needs an argument", r)
+					}
+					i++
+					value = args[i]
+				}
+				if err := dv.Set(value); err != nil {
+					return ErrorWrapper(err, 400, "invalid value %q for flag -%c: %v", c.displayValue(dv.name, value), r, err)
+				}
+				break
+			}
+
+		default:
+			p.args = append(p.args, arg)
+		}
+	}
+	return nil
+}
+
+// Args returns the arguments left after ParseFlags
+func (c *Structure) Args() []string {
+	if c.posix == nil {
+		return nil
+	}
+	return c.posix.args
+}
+
+// printPOSIXUsage prints the long and short flags of c
+func (c *Structure) printPOSIXUsage() {
+	out := c.flags().Output()
+	name := c.flags().Name()
+	if c.flags() == flag.CommandLine {
+		name = os.Args[0]
+	}
+	fmt.Fprintf(out, "Usage of %s:\n", name)
+	for _, extra := range []string{"config", "set"} {
+		if f := c.posix.extra[extra]; f != nil {
+			typeName, usage := flag.UnquoteUsage(f)
+			printFlag(out, "    --"+f.Name, typeName, usage)
+		}
+	}
+	c.printFlagUsage(out, func(key string) (string, *dynamicVar) {
+		name, ok := c.posix.names[key]
+		if !ok {
+			return "", nil
+		}
+		dv := c.posix.long[name]
+		flagName := "    --" + name
+		if r, ok := c.posix.shorts[key]; ok {
+			flagName = fmt.Sprintf("-%c, --%s", r, name)
+		}
+		if dv.IsBoolFlag() {
+			flagName += ", --no-" + name
+		}
+		return flagName, dv
+	})
+}
@@ -0,0 +1,126 @@
+package cfggo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// secretRefPrefix marks a config file value that is a reference to a secret, eg. "ref+env://DB_PASS"
+const secretRefPrefix = "ref+"
+
+// SecretResolver resolves the location of a secret reference, the part after "ref+<scheme>://"
+type SecretResolver interface {
+	Resolve(location string) (string, error)
+}
+
+// SecretResolverFunc adapts a function to a SecretResolver
+type SecretResolverFunc func(location string) (string, error)
+
+func (f SecretResolverFunc) Resolve(location string) (string, error) {
+	return f(location)
+}
+
+var (
+	secretResolversMutex sync.RWMutex
+	secretResolvers      = map[string]SecretResolver{
+		"file": SecretResolverFunc(resolveFileSecret),
+		"env":  SecretResolverFunc(resolveEnvSecret),
+	}
+)
+
+// RegisterSecretResolver makes resolver handle "ref+<scheme>://" references, replacing any
+// resolver already registered for scheme
+func RegisterSecretResolver(scheme string, resolver SecretResolver) {
+	secretResolversMutex.Lock()
+	defer secretResolversMutex.Unlock()
+	secretResolvers[scheme] = resolver
+}
+
+// resolveFileSecret reads "ref+file:///run/secrets/db", without a trailing newline
+func resolveFileSecret(location string) (string, error) {
+	data, err := os.ReadFile(location)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimRight(data, "\r\n")), nil
+}
+
+// resolveEnvSecret reads "ref+env://DB_PASS"
+func resolveEnvSecret(location string) (string, error) {
+	value, ok := os.LookupEnv(location)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", location)
+	}
+	return value, nil
+}
+
+// ExecSecretResolver runs "ref+exec:///usr/bin/get-secret db" and uses its output, without
+// a trailing newline. It is not registered by default, as it lets anyone who can edit the
+// config file run commands: RegisterSecretResolver("exec", cfggo.ExecSecretResolver())
+func ExecSecretResolver() SecretResolver {
+	return SecretResolverFunc(func(location string) (string, error) {
+		args := strings.Fields(location)
+		if len(args) == 0 {
+			return "", fmt.Errorf("empty command")
+		}
+		out, err := exec.Command(args[0], args[1:]...).Output()
+		if err != nil {
+			return "", err
+		}
+		return string(bytes.TrimRight(out, "\r\n")), nil
+	})
+}
+
+// ResolveSecretRef resolves a reference such as "ref+file:///run/secrets/db" with the
+// registered resolvers
+func ResolveSecretRef(ref string) (string, error) {
+	scheme, location, ok := strings.Cut(strings.TrimPrefix(ref, secretRefPrefix), "://")
+	if !ok || !strings.HasPrefix(ref, secretRefPrefix) {
+		return "", fmt.Errorf("invalid secret reference %q", ref)
+	}
+	secretResolversMutex.RLock()
+	resolver, ok := secretResolvers[scheme]
+	secretResolversMutex.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("no resolver registered for secret reference scheme %s", scheme)
+	}
+	return resolver.Resolve(location)
+}
+
+// secretRef returns the reference held in raw, if raw is a JSON string holding one
+func secretRef(raw json.RawMessage) (string, bool) {
+	if !bytes.HasPrefix(bytes.TrimSpace(raw), []byte(`"`+secretRefPrefix)) {
+		return "", false
+	}
+	var ref string
+	if err := json.Unmarshal(raw, &ref); err != nil {
+		return "", false
+	}
+	return ref, true
+}
+
+// prepareForSave returns the value to write to the config file for key: the original reference
+// for resolved secrets, so they are never written out, otherwise the possibly encrypted value.
+// Unencrypted values equal to the ones in loaded, the document the config was loaded from, are
+// returned as loaded, so "5s" isn't rewritten as 5000000000.
+func (c *Structure) prepareForSave(key string, value interface{}, loaded map[string]json.RawMessage, encrypted map[string]string) (interface{}, error) {
+	if ref, ok := c.secretRefs[key]; ok {
+		return ref, nil
+	}
+	saved, err := c.encryptForSave(key, encodeJSONValue(value, true), encrypted)
+	if _, ok := encrypted[key]; err != nil || ok || value == nil {
+		return saved, err
+	}
+	if raw, ok := lookupJSONPath(loaded, strings.Split(key, ".")); ok && !isEncryptedValue(raw) {
+		if decoded, err := decodeJSONValue(reflect.TypeOf(value), raw); err == nil && reflect.DeepEqual(decoded.Interface(), value) {
+			return raw, nil
+		}
+	}
+	return saved, nil
+}
@@ -0,0 +1,102 @@
+package cfggo
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"reflect"
+)
+
+// secretMask replaces secret values wherever they would be displayed
+const secretMask = "******"
+
+// secretValue is implemented by Secret, marking values that must not be displayed
+type secretValue interface {
+	secret() interface{}
+}
+
+// errSecretValue replaces parse errors of secret values, which often quote the value
+var errSecretValue = errors.New("invalid secret value")
+
+// Secret wraps a config value that must not be displayed. It prints and marshals to JSON as a
+// mask, including in String(), logs, flag defaults and GetJSONBytes, but is saved as is. Use
+// Value to get the real value.
+// Fields can also be marked with a `secret:"true"` tag instead.
+type Secret[T any] struct {
+	value T
+}
+
+// NewSecret returns a Secret holding v
+func NewSecret[T any](v T) Secret[T] {
+	return Secret[T]{value: v}
+}
+
+// Value returns the real value
+func (s Secret[T]) Value() T {
+	return s.value
+}
+
+// secret returns the real value, for saving
+func (s Secret[T]) secret() interface{} {
+	return s.value
+}
+
+func (s Secret[T]) String() string {
+	return secretMask
+}
+
+func (s Secret[T]) GoString() string {
+	return secretMask
+}
+
+// LogValue masks the value in slog output
+func (s Secret[T]) LogValue() slog.Value {
+	return slog.StringValue(secretMask)
+}
+
+func (s Secret[T]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(secretMask)
+}
+
+func (s *Secret[T]) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &s.value); err != nil {
+		return errSecretValue
+	}
+	return nil
+}
+
+func (s *Secret[T]) UnmarshalText(text []byte) error {
+	value, err := parseValue(reflect.TypeOf(&s.value).Elem(), string(text))
+	if err != nil {
+		return errSecretValue
+	}
+	reflect.ValueOf(&s.value).Elem().Set(value)
+	return nil
+}
+
+// isSecret reports whether the value of key must be masked when displayed. It only reads the
+// published state and the secret tags, which are fixed by Init, so it needs no lock.
+func (c *Structure) isSecret(key string) bool {
+	if c.secretKeys[key] {
+		return true
+	}
+	state := c.state.Load()
+	return state != nil && state.secrets[key]
+}
+
+// displayValue returns value, or the mask if key is secret
+func (c *Structure) displayValue(key string, value interface{}) interface{} {
+	if c.isSecret(key) {
+		return secretMask
+	}
+	return value
+}
+
+// maskError returns err, or an error without its message if key is secret, as parse errors
+// often quote the value they failed on
+func (c *Structure) maskError(key string, err error) error {
+	if err != nil && c.isSecret(key) {
+		return errSecretValue
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package cfggo
+
+import (
+	"reflect"
+	"sort"
+)
+
+// Snapshot is a point-in-time copy of a config's values and where they came from. It doesn't
+// change when the config does, and can be given to Restore to roll the config back.
+type Snapshot struct {
+	version uint64
+	values  map[string]interface{}
+	sources map[string]Source
+}
+
+// Snapshot returns a copy of the current values
+func (c *Structure) Snapshot() *Snapshot {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	s := &Snapshot{
+		values:  make(map[string]interface{}, len(c.configData)),
+		sources: make(map[string]Source, len(c.sources)),
+	}
+	if state := c.state.Load(); state != nil {
+		s.version = state.version
+	}
+	for key, value := range c.configData {
+		s.values[key] = copyAny(value)
+	}
+	for key, source := range c.sources {
+		s.sources[key] = source
+	}
+	return s
+}
+
+// Restore sets every value back to the one in s, removing keys added with Set since. Nothing
+// is changed if a value no longer has the type of the key's current value.
+func (c *Structure) Restore(s *Snapshot) error {
+	c.mu.Lock()
+	for key, value := range s.values {
+		if _, err := c.convertValue(key, value); err != nil {
+			c.mu.Unlock()
+			return err
+		}
+	}
+
+	var changed []string
+	sourcesChanged := false
+	for key := range c.configData {
+		if _, ok := s.values[key]; !ok {
+			delete(c.configData, key)
+			delete(c.sources, key)
+			changed = append(changed, key)
+		}
+	}
+	for key, value := range s.values {
+		value = copyAny(value)
+		if c.valueChanged(key, value) {
+			changed = append(changed, key)
+		}
+		c.set(key, value)
+		if source, ok := s.sources[key]; ok {
+			sourcesChanged = sourcesChanged || c.sources[key] != source
+			c.setSource(key, source)
+		} else if _, ok := c.sources[key]; ok {
+			sourcesChanged = true
+			delete(c.sources, key)
+		}
+	}
+	sort.Strings(changed)
+	if len(changed) > 0 || sourcesChanged {
+		c.changed = true // Only then does the config need saving
+	}
+	c.publish()
+	listeners := c.listeners
+	c.mu.Unlock()
+
+	notifyChange(listeners, changed)
+	return nil
+}
+
+// Version identifies the state of the config the snapshot was taken of, it increases with
+// every change
+func (s *Snapshot) Version() uint64 {
+	return s.version
+}
+
+// Get returns a copy of the value of key
+func (s *Snapshot) Get(key string) (interface{}, bool) {
+	value, exists := s.values[key]
+	return copyAny(value), exists
+}
+
+// Source returns where the value of key came from
+func (s *Snapshot) Source(key string) Source {
+	return s.sources[key]
+}
+
+// Keys returns the keys in the snapshot, sorted
+func (s *Snapshot) Keys() []string {
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// copyAny returns a deep copy of value, so slices and maps in a snapshot aren't shared
+func copyAny(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	return copyValue(reflect.ValueOf(value)).Interface()
+}
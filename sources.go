@@ -2,24 +2,45 @@ package cfggo
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 )
 
 type configHandler interface {
-	LoadConfig() ([]byte, error)
-	SaveConfig(data []byte) error
+	LoadConfig(ctx context.Context) ([]byte, error)
+	SaveConfig(ctx context.Context, data []byte) error
+}
+
+// configUpdater is implemented by handlers that can save based on the current contents of the
+// config, without other writers changing it in between
+type configUpdater interface {
+	UpdateConfig(ctx context.Context, update func(current []byte) ([]byte, error)) error
 }
 
 type handlerFile struct {
 	filename string
+	mode     os.FileMode // File mode for saved files, defaults to the existing file's mode or 0644
+	backups  int         // Number of backups to keep when saving (filename.1, filename.2, ...)
 }
 
-func (h *handlerFile) LoadConfig() ([]byte, error) {
+func (h *handlerFile) LoadConfig(ctx context.Context) ([]byte, error) {
 	if h.filename == "" {
 		return nil, nil
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, ErrorWrapper(err, 0, "")
+	}
+	// Shares the lock savers take, so the file can't be replaced while it is read
+	unlock, err := h.lock(false)
+	if err != nil {
+		return nil, ErrorWrapper(err, 0, "")
+	}
+	defer unlock()
+
 	data, err := os.ReadFile(h.filename)
 	if err != nil {
 		return nil, ErrorWrapper(err, 0, "")
@@ -27,28 +48,181 @@ func (h *handlerFile) LoadConfig() ([]byte, error) {
 	return data, nil
 }
 
-func (h *handlerFile) SaveConfig(data []byte) error {
+// SaveConfig replaces the config file with data
+func (h *handlerFile) SaveConfig(ctx context.Context, data []byte) error {
+	return h.UpdateConfig(ctx, func(current []byte) ([]byte, error) {
+		return data, nil
+	})
+}
+
+// UpdateConfig replaces the config file with the result of update, which is given the current
+// contents of the file (nil if it doesn't exist). An exclusive lock is held throughout, so other
+// processes saving the same file can't change it in between.
+func (h *handlerFile) UpdateConfig(ctx context.Context, update func(current []byte) ([]byte, error)) error {
 	if h.filename == "" {
 		return ErrorWrapper(nil, 400, "filename is empty")
 	}
-	err := os.WriteFile(h.filename, data, 0644)
+	if err := ctx.Err(); err != nil {
+		return ErrorWrapper(err, 0, "")
+	}
+	unlock, err := h.lock(true)
+	if err != nil {
+		return ErrorWrapper(err, 0, "")
+	}
+	defer unlock()
+
+	current, err := os.ReadFile(h.filename)
+	if err != nil && !os.IsNotExist(err) {
+		return ErrorWrapper(err, 0, "")
+	}
+	data, err := update(current)
+	if err != nil {
+		return err
+	}
+	return h.writeFile(data)
+}
+
+// lock takes an advisory lock on a .lock file next to the config file, exclusive for saving and
+// shared for loading, and the last holder removes it again on unlock. The config file itself
+// can't be locked, as saving replaces it with a new file.
+func (h *handlerFile) lock(exclusive bool) (unlock func(), err error) {
+	filename := h.filename
+	if target, err := filepath.EvalSymlinks(filename); err == nil {
+		filename = target
+	}
+	lockName := filename + ".lock"
+	for {
+		f, err := os.OpenFile(lockName, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			if !exclusive {
+				// Loading from a directory the .lock file can't be created in, eg. a read-only one
+				return func() {}, nil
+			}
+			return nil, err
+		}
+		if err := lockFile(f, exclusive); err != nil {
+			f.Close()
+			return nil, err
+		}
+		// The previous holder removes the file, so it may no longer be the one we locked
+		locked, err := f.Stat()
+		if err != nil {
+			unlockFile(f)
+			f.Close()
+			return nil, err
+		}
+		if current, err := os.Stat(lockName); err == nil && os.SameFile(locked, current) {
+			return func() {
+				// Other readers may still hold a shared lock, the file is theirs to remove then
+				if exclusive || tryLockFile(f) {
+					if current, err := os.Stat(lockName); err == nil && os.SameFile(locked, current) {
+						os.Remove(lockName)
+					}
+				}
+				unlockFile(f)
+				f.Close()
+			}, nil
+		}
+		unlockFile(f)
+		f.Close()
+	}
+}
+
+// writeFile writes data to a temporary file in the same directory, syncs it and renames it
+// over the config file, so the config file is never left partially written
+func (h *handlerFile) writeFile(data []byte) error {
+	filename := h.filename
+	if target, err := filepath.EvalSymlinks(filename); err == nil {
+		filename = target // Replace the file a symlink points at, not the symlink
+	}
+
+	mode := h.mode
+	if mode == 0 {
+		mode = 0644
+		if info, err := os.Stat(filename); err == nil {
+			mode = info.Mode().Perm()
+		}
+	}
+
+	dir := filepath.Dir(filename)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(filename)+".tmp*")
 	if err != nil {
 		return ErrorWrapper(err, 0, "")
 	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return ErrorWrapper(err, 0, "")
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return ErrorWrapper(err, 0, "")
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return ErrorWrapper(err, 0, "")
+	}
+	if err := tmp.Close(); err != nil {
+		return ErrorWrapper(err, 0, "")
+	}
+
+	if h.backups > 0 {
+		if err := rotateBackups(filename, h.backups); err != nil {
+			return ErrorWrapper(err, 0, "")
+		}
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return ErrorWrapper(err, 0, "")
+	}
+
+	// Sync the directory so the rename itself survives a crash
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
 	return nil
 }
 
+// rotateBackups shifts filename.1 to filename.2 and so on, dropping the oldest, then copies
+// filename to filename.1. The config file itself stays in place until it is replaced.
+func rotateBackups(filename string, backups int) error {
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return nil
+	}
+	for i := backups; i > 1; i-- {
+		older := fmt.Sprintf("%s.%d", filename, i-1)
+		if err := os.Rename(older, fmt.Sprintf("%s.%d", filename, i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	backup := filename + ".1"
+	os.Remove(backup)
+	if err := os.Link(filename, backup); err == nil {
+		return nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(backup, data, info.Mode().Perm())
+}
+
 type handlerHTTP struct {
 	source http.Request
 	dest   http.Request
 }
 
-func (h *handlerHTTP) LoadConfig() ([]byte, error) {
+func (h *handlerHTTP) LoadConfig(ctx context.Context) ([]byte, error) {
 	if h.source.URL.String() == "" {
 		return nil, ErrorWrapper(nil, 400, "source URL is empty")
 	}
 
-	req, err := http.NewRequest(h.source.Method, h.source.URL.String(), h.source.Body)
+	req, err := http.NewRequestWithContext(ctx, h.source.Method, h.source.URL.String(), h.source.Body)
 	if err != nil {
 		return nil, ErrorWrapper(err, 0, "")
 	}
@@ -71,12 +245,12 @@ func (h *handlerHTTP) LoadConfig() ([]byte, error) {
 	return data, nil
 }
 
-func (h *handlerHTTP) SaveConfig(data []byte) error {
+func (h *handlerHTTP) SaveConfig(ctx context.Context, data []byte) error {
 	if h.dest.URL.String() == "" {
 		return ErrorWrapper(nil, 400, "destination URL is empty")
 	}
 
-	req, err := http.NewRequest(h.dest.Method, h.dest.URL.String(), bytes.NewReader(data))
+	req, err := http.NewRequestWithContext(ctx, h.dest.Method, h.dest.URL.String(), bytes.NewReader(data))
 	if err != nil {
 		return ErrorWrapper(err, 0, "")
 	}
@@ -1,37 +1,91 @@
 package cfggo
 
 import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"errors"
 	"flag"
-	"fmt"
+	"io/fs"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"sync"
+	"sync/atomic"
 )
 
-var configMutex sync.RWMutex
+type Structure struct {
+	mu                 sync.RWMutex                // Guards configData and the maps describing it
+	saveMu             sync.Mutex                  // Serializes saves, so they don't see each other as changes on disk
+	state              atomic.Pointer[configState] // The published values, read without locking
+	funcTypes          map[string]reflect.Type     // Result types of the func fields by key
+	listeners          []func(keys []string)       // Called after values change
+	flagSet            *flag.FlagSet               // Flag set the config flags are added to, flag.CommandLine if nil
+	defaults           map[string]interface{}      // Default values of the struct fields, shown in the flag usage
+	skipFlagUsage      bool                        // Leave the flag set's usage function alone
+	posix              *posixFlags                 // GNU style flags, parsed with ParseFlags (optional)
+	configFlag         bool                        // Add a --config flag choosing the config file
+	setFlag            bool                        // Add a repeatable --set key=value flag
+	completion         bool                        // Add a hidden --completion flag asking for a completion script
+	completionScript   string                      // Script asked for with --completion, see Completion
+	name               string                      // Name given to this configuration (useful when loading multiple configs)
+	configHandler      configHandler               // Configuration handler (optional)
+	skipEnv            bool                        // Skip Environment variables
+	createdFile        bool                        // Did we create the config file
+	changed            bool                        // Has the config changed (used to trigger save on exit)
+	defaultsAlreadySet bool                        // Are the defaults already set
+	parent             interface{}                 // This is a pointer to the parent struct
+	configData         map[string]interface{}      // Where the configuration data is stored
+	plainFields        map[string]reflect.Value    // Plain (non func) struct fields kept in sync with configData
+	secretKeys         map[string]bool             // Keys tagged secret:"true", masked when displayed
+	oneOf              map[string][]string         // Values allowed for keys tagged oneof:"a b c"
+	encryptedKeys      map[string]string           // Encrypted values by key, re-encrypted on save
+	document           []byte                      // The config document as loaded or last saved
+	keyProvider        KeyProvider                 // Key for encrypted values (optional)
+	secretRefs         map[string]string           // Secret references the values of keys were resolved from
+	sources            map[string]Source           // Where the current value of each key came from, unset for defaults
+	sparseSave         bool                        // Only save keys loaded from the config file or Set
+	skipSaveOnExit     bool                        // Don't save on SIGINT/SIGTERM, the app calls Save or SaveAll
+	exitFunc           func()                      // Called instead of os.Exit for this config after saving on SIGINT/SIGTERM (optional)
+	validators         []func(s *Snapshot) error   // Check the config as a whole before Set, Update and CompareAndSwap
+}
 
-func init() {
-	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
-		flag.PrintDefaults()
-		// fmt.Println("Configuration parameters:")
-		// for name := range flag.CommandLine.NFlag() {
-		// 	fmt.Printf("  %s\n", name)
-		// }
-	}
+// configState is an immutable copy of the config values. A new one is published whenever values
+// change, so the func fields and Get can read them without locking.
+type configState struct {
+	version uint64                     // Incremented on every change
+	data    map[string]interface{}     // Values by key
+	results map[string][]reflect.Value // Results of the func fields by key
+	secrets map[string]bool            // Keys holding Secret values or resolved secret references
 }
 
-type Structure struct {
-	name               string                 // Name given to this configuration (useful when loading multiple configs)
-	configHandler      configHandler          // Configuration handler (optional)
-	skipEnv            bool                   // Skip Environment variables
-	createdFile        bool                   // Did we create the config file
-	changed            bool                   // Has the config changed (used to trigger save on exit)
-	defaultsAlreadySet bool                   // Are the defaults already set
-	parent             interface{}            // This is a pointer to the parent struct
-	configData         map[string]interface{} // Where the configuration data is stored
+// Source is where the current value of a config key came from
+type Source int
+
+const (
+	SourceDefault Source = iota // The struct's default
+	SourceFile                  // The config file (or HTTP source)
+	SourceEnv                   // An environment variable
+	SourceFlag                  // A command-line flag
+	SourceSet                   // A call to Set
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceDefault:
+		return "default"
+	case SourceFile:
+		return "file"
+	case SourceEnv:
+		return "env"
+	case SourceFlag:
+		return "flag"
+	case SourceSet:
+		return "set"
+	}
+	return "unknown"
 }
 
 // DefaultValue returns a function that returns the type of the input parameter X
@@ -88,7 +142,10 @@ func (c *Structure) Init(parent interface{}, options ...Option) {
 
 	// LoadConfig
 	if c.configHandler != nil {
-		c.loadConfig()
+		c.setupConfigSaver()
+		if err := c.loadConfig(context.Background()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			Logger.Error("Structure: Init() error loading config: %v", err)
+		}
 	}
 
 	// Logger.Info("loadFromEnv %s", name)
@@ -96,6 +153,9 @@ func (c *Structure) Init(parent interface{}, options ...Option) {
 
 	// Logger.Info("CreateFlags %s", name)
 	c.createFlags()
+	if !c.skipFlagUsage && c.posix == nil {
+		c.setupFlagUsage()
+	}
 
 	// Logger.Info("Done Init")
 }
@@ -118,70 +178,270 @@ func (c *Structure) setupConfigData() {
 		return
 	}
 
-	t := v.Type()
+	c.walkConfigFields(v, nil, func(path []string, field reflect.StructField, fieldValue reflect.Value) {
+		configVarName := strings.Join(path, ".")
+		if secret, _ := strconv.ParseBool(field.Tag.Get("secret")); secret {
+			if c.secretKeys == nil {
+				c.secretKeys = make(map[string]bool)
+			}
+			c.secretKeys[configVarName] = true
+		}
+		if oneOf := strings.Fields(field.Tag.Get("oneof")); len(oneOf) > 0 {
+			if c.oneOf == nil {
+				c.oneOf = make(map[string][]string)
+			}
+			c.oneOf[configVarName] = oneOf
+		}
+		if fieldValue.Kind() == reflect.Func && fieldValue.IsNil() {
+			// Set the default value in the map, to the reflect.Zero of the type returned from the config function
+			c.set(configVarName, reflect.Zero(fieldValue.Type().Out(0)).Interface())
+		} else if fieldValue.Kind() == reflect.Func {
+			// Set the default value in the map, to the value (and type) returned from the config function
+			c.set(configVarName, fieldValue.Call(nil)[0].Interface())
+		} else {
+			// Plain fields hold their own default, and are written to whenever the value changes
+			if c.plainFields == nil {
+				c.plainFields = make(map[string]reflect.Value)
+			}
+			c.plainFields[configVarName] = fieldValue
+			c.set(configVarName, fieldValue.Interface())
+		}
+		if c.defaults == nil {
+			c.defaults = make(map[string]interface{})
+		}
+		c.defaults[configVarName] = c.configData[configVarName]
+	})
+}
 
+// walkConfigFields calls fn for every config field of the struct v, descending into nested structs.
+// Joining the path with "." gives the config key.
+func (c *Structure) walkConfigFields(v reflect.Value, prefix []string, fn func(path []string, field reflect.StructField, fieldValue reflect.Value)) {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+
+	t := v.Type()
 	for i := 0; i < v.NumField(); i++ {
 		field := t.Field(i)
 		if field.Type == reflect.TypeOf(Structure{}) && field.Anonymous {
 			continue
 		}
+		if !field.IsExported() && !field.Anonymous {
+			continue
+		}
 		fieldValue := v.Field(i)
 
+		if field.Anonymous && isConfigSection(field.Type) {
+			// Embedded structs share the key space of their parent
+			c.walkConfigFields(fieldValue, prefix, fn)
+			continue
+		}
+
 		configVarName := c.getConfigNameFromField(field)
 		if configVarName == "" || configVarName == "-" {
 			continue
 		}
-
-		if configVarName == "" {
-			Logger.Warn("No config or json tag found for field %s", field.Name)
-			configVarName = t.Field(i).Name
+		path := append(append([]string(nil), prefix...), configVarName)
+
+		if isConfigSection(field.Type) {
+			c.walkConfigFields(fieldValue, path, fn)
+		} else if isConfigFunc(field.Type) {
+			fn(path, field, fieldValue)
+		} else if _, ok := field.Tag.Lookup("config"); ok && field.Type.Kind() != reflect.Func {
+			fn(path, field, fieldValue)
 		}
+	}
+}
 
-		if fieldValue.Kind() == reflect.Func && fieldValue.IsNil() {
-			// Set the default value in the map, to the reflect.Zero of the type returned from the config function
-			c.set(configVarName, reflect.Zero(fieldValue.Type().Out(0)).Interface())
-		} else if fieldValue.Kind() == reflect.Func {
-			// Set the default value in the map, to the value (and type) returned from the config function
-			c.set(configVarName, fieldValue.Call(nil)[0].Interface())
+// isConfigFunc reports whether t is a 'func() T' accessor
+func isConfigFunc(t reflect.Type) bool {
+	return t.Kind() == reflect.Func && t.NumIn() == 0 && t.NumOut() == 1
+}
+
+// configValueType returns the type of the value held for a config field, T for both 'func() T' and 'T'
+func configValueType(t reflect.Type) reflect.Type {
+	if isConfigFunc(t) {
+		return t.Out(0)
+	}
+	return t
+}
+
+// isConfigSection reports whether a struct field of type t holds a nested group of config
+// items rather than a single value. Types that decode themselves (time.Time, etc.) and structs
+// without any config fields are values.
+func isConfigSection(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct || isSelfDecoding(t) {
+		return false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() && !field.Anonymous {
+			continue
+		}
+		if _, ok := field.Tag.Lookup("config"); ok || isConfigFunc(field.Type) || isConfigSection(field.Type) {
+			return true
 		}
 	}
+	return false
+}
+
+// isSelfDecoding reports whether t decodes itself from text or JSON
+func isSelfDecoding(t reflect.Type) bool {
+	ptr := reflect.PointerTo(t)
+	return ptr.Implements(reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()) ||
+		ptr.Implements(reflect.TypeOf((*json.Unmarshaler)(nil)).Elem())
 }
 
 // Set sets a configuration value and then updates the config struct as well
 func (c *Structure) Set(key string, value interface{}) error {
-	configMutex.Lock()
-	defer configMutex.Unlock()
+	return c.setFrom(key, value, SourceSet)
+}
+
+// setFrom sets a configuration value, recording where it came from
+func (c *Structure) setFrom(key string, value interface{}, source Source) error {
+	if err := c.validateValue(key, value); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	value, err := c.convertValue(key, value)
+	if err == nil && source == SourceSet {
+		err = c.validateConfig(map[string]interface{}{key: value})
+	}
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	isChange := c.valueChanged(key, value)
 	c.changed = true
-	return c.set(key, value)
+	if err := c.set(key, value); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	c.setSource(key, source)
+	c.publish()
+	listeners := c.listeners
+	c.mu.Unlock()
+
+	if isChange {
+		notifyChange(listeners, []string{key})
+	}
+	return nil
+}
+
+// publish makes the current values visible to readers, it must be called with c.mu held after
+// values change
+func (c *Structure) publish() {
+	state := &configState{
+		data:    make(map[string]interface{}, len(c.configData)),
+		results: make(map[string][]reflect.Value, len(c.funcTypes)),
+	}
+	if previous := c.state.Load(); previous != nil {
+		state.version = previous.version + 1
+	}
+	for key, value := range c.configData {
+		state.data[key] = value
+		if _, ok := value.(secretValue); ok {
+			state.secret(key)
+		}
+	}
+	for key := range c.secretRefs {
+		state.secret(key)
+	}
+	for key, t := range c.funcTypes {
+		// Results are built once here, so calling a func field doesn't allocate
+		result := reflect.New(t).Elem()
+		if value := state.data[key]; value != nil && reflect.TypeOf(value).AssignableTo(t) {
+			result.Set(reflect.ValueOf(value))
+		}
+		state.results[key] = []reflect.Value{result}
+	}
+	c.state.Store(state)
+}
+
+// secret marks the value of key as one to mask
+func (s *configState) secret(key string) {
+	if s.secrets == nil {
+		s.secrets = make(map[string]bool)
+	}
+	s.secrets[key] = true
+}
+
+// setSource records where the value of key came from, without locking. Values set by the app
+// replace any secret reference the key was resolved from, so they are saved.
+func (c *Structure) setSource(key string, source Source) {
+	if c.sources == nil {
+		c.sources = make(map[string]Source)
+	}
+	c.sources[key] = source
+	if source == SourceSet {
+		delete(c.secretRefs, key)
+	}
+}
+
+// Source returns where the current value of key came from
+func (c *Structure) Source(key string) Source {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sources[key]
 }
 
 // set is a private function that sets a configuration value without locking
 func (c *Structure) set(key string, value interface{}) error {
+	value, err := c.convertValue(key, value)
+	if err != nil {
+		return err
+	}
+	c.configData[key] = value
+	if fieldValue, ok := c.plainFields[key]; ok {
+		if value == nil {
+			fieldValue.Set(reflect.Zero(fieldValue.Type()))
+		} else {
+			fieldValue.Set(reflect.ValueOf(value))
+		}
+	}
+	return nil
+}
+
+// convertValue converts value to the type of the current value of key, without locking
+func (c *Structure) convertValue(key string, value interface{}) (interface{}, error) {
 	if existing, exists := c.configData[key]; exists {
 		if reflect.TypeOf(value) != reflect.TypeOf(existing) && reflect.TypeOf(value).ConvertibleTo(reflect.TypeOf(existing)) {
 			value = reflect.ValueOf(value).Convert(reflect.TypeOf(existing)).Interface()
 		}
 		if reflect.TypeOf(value) != reflect.TypeOf(existing) {
-			return ErrorWrapper(nil, 400, "Type mismatch for key %s: %T != %T", key, value, existing)
+			return nil, ErrorWrapper(nil, 400, "Type mismatch for key %s: %T != %T", key, value, existing)
 		}
 	}
-	c.configData[key] = value
-	return nil
+	return value, nil
 }
 
 // Get gets a configuration value and whether it exists from the configData
 func (c *Structure) Get(key string) (interface{}, bool) {
-	configMutex.RLock()
-	defer configMutex.RUnlock()
+	if state := c.state.Load(); state != nil {
+		value, exists := state.data[key]
+		return value, exists
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	value, exists := c.configData[key]
 	return value, exists
 }
 
 func (c *Structure) createFlags() {
+	if c.posix != nil {
+		c.createPOSIXFlags()
+		return
+	}
 	for key, value := range c.configData {
-		configDescription := "" // You can set a default description or fetch it from somewhere if needed
-		c.NewFlag(key, value, configDescription)
+		c.NewFlag(key, value, c.flagDescription(key))
 	}
+	c.createBuiltinFlags()
 }
 
 // var once sync.Once
@@ -203,59 +463,29 @@ func (c *Structure) replaceConfigFuncs() {
 		return
 	}
 
-	t := v.Type()
-
-	for i := 0; i < v.NumField(); i++ {
-		field := t.Field(i)
-		fieldValue := v.Field(i)
-
-		if fieldValue.Kind() == reflect.Func {
-			configVarName := c.getConfigNameFromField(field)
-
-			if _, exists := c.configData[configVarName]; !exists {
-				Logger.Error("Missing configData value for key %s", configVarName)
-				continue
-			}
-
-			if configVarName != "" && configVarName != "-" {
-				// Logger.Debugf("making Func %s of type %s", configVarName, fieldValue.Type())
-				fieldValue.Set(reflect.MakeFunc(fieldValue.Type(), func(args []reflect.Value) (results []reflect.Value) {
-					return []reflect.Value{reflect.ValueOf(c.configData[configVarName])}
-				}))
-			}
-		}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.funcTypes == nil {
+		c.funcTypes = make(map[string]reflect.Type)
 	}
-}
-
-// create struct create a new struct based on the config data
-func (c *Structure) createStruct() interface{} {
-	ptype := reflect.TypeOf(c.parent).Elem() // always a pointer.
-	fields := make([]reflect.StructField, 0)
-	for i := range ptype.NumField() {
-		field := ptype.Field(i)
-		if field.Type == reflect.TypeOf(Structure{}) && field.Anonymous {
-			continue
-		}
-		if field.Type.Kind() == reflect.Func && field.Type.NumIn() == 0 && field.Type.NumOut() == 1 {
-			field.Type = field.Type.Out(0) // transform 'func() T' to 'T'
+	c.walkConfigFields(v, nil, func(path []string, field reflect.StructField, fieldValue reflect.Value) {
+		if fieldValue.Kind() != reflect.Func {
+			return
 		}
-		fields = append(fields, field)
-	}
-	resp := reflect.New(reflect.StructOf(fields)).Interface()
+		configVarName := strings.Join(path, ".")
 
-	// Add values to the struct
-	rvalue := reflect.ValueOf(resp).Elem()
-	rtype := rvalue.Type()
-	for i := range rvalue.NumField() {
-		field := rtype.Field(i)
-		configKey := c.getConfigNameFromField(field)
-		if configKey == "" || configKey == "-" {
-			continue
+		if _, exists := c.configData[configVarName]; !exists {
+			Logger.Error("Missing configData value for key %s", configVarName)
+			return
 		}
-		// fmt.Printf("setting default struct field value %s to %v\n", configKey, c.configData[configKey])
-		rvalue.Field(i).Set(reflect.ValueOf(c.configData[configKey]))
-	}
-	return resp
+		c.funcTypes[configVarName] = fieldValue.Type().Out(0)
+
+		// Logger.Debugf("making Func %s of type %s", configVarName, fieldValue.Type())
+		fieldValue.Set(reflect.MakeFunc(fieldValue.Type(), func(args []reflect.Value) (results []reflect.Value) {
+			return c.state.Load().results[configVarName]
+		}))
+	})
+	c.publish()
 }
 
 func (c *Structure) getConfigNameFromField(field reflect.StructField) string {
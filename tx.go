@@ -0,0 +1,132 @@
+package cfggo
+
+import (
+	"reflect"
+)
+
+// Tx stages changes to a config made within Update
+type Tx struct {
+	c      *Structure
+	keys   []string // Staged keys, in the order they were first set
+	values map[string]interface{}
+}
+
+// Set stages a new value for key. The value is validated and type checked now, but only
+// applied when the Update function returns without error.
+func (tx *Tx) Set(key string, value interface{}) error {
+	if err := tx.c.validateValue(key, value); err != nil {
+		return err
+	}
+	tx.c.mu.RLock()
+	value, err := tx.c.convertValue(key, value)
+	tx.c.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if _, staged := tx.values[key]; !staged {
+		tx.keys = append(tx.keys, key)
+	}
+	tx.values[key] = value
+	return nil
+}
+
+// Get returns the staged value of key, or its current value if it isn't staged
+func (tx *Tx) Get(key string) (interface{}, bool) {
+	if value, staged := tx.values[key]; staged {
+		return value, true
+	}
+	return tx.c.Get(key)
+}
+
+// Update calls fn to stage changes with tx.Set, then applies all of them at once, so readers
+// never see some of the changes without the others. The staged values are checked together by
+// the validators added with WithValidator, and nothing is changed if they, fn, or applying any
+// of the values, return an error. Listeners added with OnChange are notified once.
+func (c *Structure) Update(fn func(tx *Tx) error) error {
+	tx := &Tx{c: c, values: make(map[string]interface{})}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if len(tx.keys) == 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	// Check every value again, as the config may have changed since it was staged
+	for _, key := range tx.keys {
+		value, err := c.convertValue(key, tx.values[key])
+		if err != nil {
+			c.mu.Unlock()
+			return err
+		}
+		tx.values[key] = value
+	}
+	if err := c.validateConfig(tx.values); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	var changed []string
+	c.changed = true
+	for _, key := range tx.keys {
+		if c.valueChanged(key, tx.values[key]) {
+			changed = append(changed, key)
+		}
+		c.set(key, tx.values[key])
+		c.setSource(key, SourceSet)
+	}
+	c.publish()
+	listeners := c.listeners
+	c.mu.Unlock()
+
+	notifyChange(listeners, changed)
+	return nil
+}
+
+// validateConfig calls the validators added with WithValidator with the config as it would be
+// with the staged values applied, without locking
+func (c *Structure) validateConfig(staged map[string]interface{}) error {
+	if len(c.validators) == 0 {
+		return nil
+	}
+	s := &Snapshot{values: make(map[string]interface{}, len(c.configData)), sources: make(map[string]Source, len(c.sources))}
+	for key, value := range c.configData {
+		s.values[key] = value
+	}
+	for key, source := range c.sources {
+		s.sources[key] = source
+	}
+	for key, value := range staged {
+		s.values[key] = value
+		s.sources[key] = SourceSet
+	}
+	for _, validator := range c.validators {
+		if err := validator(s); err != nil {
+			return ErrorWrapper(err, 400, "invalid config: %v", err)
+		}
+	}
+	return nil
+}
+
+// OnChange adds a function that is called with the keys whose values changed, after every Set,
+// Update or reload that changes values. Setting a key to the value it already has doesn't
+// notify.
+func (c *Structure) OnChange(fn func(keys []string)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listeners = append(c.listeners, fn)
+}
+
+func notifyChange(listeners []func(keys []string), keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	for _, listener := range listeners {
+		listener(append([]string(nil), keys...))
+	}
+}
+
+// valueChanged reports whether value differs from the current value of key, without locking
+func (c *Structure) valueChanged(key string, value interface{}) bool {
+	existing, exists := c.configData[key]
+	return !exists || !reflect.DeepEqual(existing, value)
+}
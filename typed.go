@@ -0,0 +1,61 @@
+package cfggo
+
+import (
+	"reflect"
+)
+
+// SetTyped sets key to value, which must have the same type as the key's current value
+func SetTyped[T any](c *Structure, key string, value T) error {
+	if existing, exists := c.Get(key); exists {
+		if want := reflect.TypeOf(existing); want != nil && want != reflect.TypeOf(&value).Elem() {
+			return ErrorWrapper(nil, 400, "Type mismatch for key %s: %T != %s", key, value, want)
+		}
+	}
+	return c.Set(key, value)
+}
+
+// GetTyped returns the value of key as a T
+func GetTyped[T any](c *Structure, key string) (T, error) {
+	var zero T
+	value, exists := c.Get(key)
+	if !exists {
+		return zero, ErrorWrapper(nil, 404, "unknown config key %s", key)
+	}
+	if value == nil {
+		return zero, nil
+	}
+	typed, ok := value.(T)
+	if !ok {
+		return zero, ErrorWrapper(nil, 400, "Type mismatch for key %s: %T != %T", key, value, zero)
+	}
+	return typed, nil
+}
+
+// CompareAndSwap sets key to new only if its current value is old, and reports whether it did.
+// Invalid new values are never set.
+func CompareAndSwap[T comparable](c *Structure, key string, old, new T) bool {
+	if err := c.validateValue(key, new); err != nil {
+		return false
+	}
+
+	c.mu.Lock()
+	current, ok := c.configData[key].(T)
+	if !ok || current != old || c.validateConfig(map[string]interface{}{key: new}) != nil {
+		c.mu.Unlock()
+		return false
+	}
+	c.changed = true
+	if err := c.set(key, new); err != nil {
+		c.mu.Unlock()
+		return false
+	}
+	c.setSource(key, SourceSet)
+	c.publish()
+	listeners := c.listeners
+	c.mu.Unlock()
+
+	if old != new {
+		notifyChange(listeners, []string{key})
+	}
+	return true
+}
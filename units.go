@@ -0,0 +1,259 @@
+package cfggo
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ByteSize is a number of bytes, written with a unit such as "512MiB" or "10GB". Binary units
+// (KiB, MiB, ...) are powers of 1024, decimal units (KB, MB, ...) powers of 1000.
+type ByteSize int64
+
+const (
+	Byte ByteSize = 1
+
+	KB ByteSize = 1000 * Byte
+	MB ByteSize = 1000 * KB
+	GB ByteSize = 1000 * MB
+	TB ByteSize = 1000 * GB
+	PB ByteSize = 1000 * TB
+
+	KiB ByteSize = 1024 * Byte
+	MiB ByteSize = 1024 * KiB
+	GiB ByteSize = 1024 * MiB
+	TiB ByteSize = 1024 * GiB
+	PiB ByteSize = 1024 * TiB
+)
+
+var byteSizeUnits = []struct {
+	name string
+	size ByteSize
+}{
+	{"PiB", PiB}, {"TiB", TiB}, {"GiB", GiB}, {"MiB", MiB}, {"KiB", KiB},
+	{"PB", PB}, {"TB", TB}, {"GB", GB}, {"MB", MB}, {"KB", KB},
+}
+
+// ParseByteSize parses a size such as "512MiB", "1.5GB" or "1024"
+func ParseByteSize(s string) (ByteSize, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.' && r != '-' && r != '+'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	number, unit := s[:i], strings.ToLower(strings.TrimSpace(s[i:]))
+
+	size := Byte
+	switch strings.TrimSuffix(unit, "b") {
+	case "":
+	case "k":
+		size = KB
+	case "m":
+		size = MB
+	case "g":
+		size = GB
+	case "t":
+		size = TB
+	case "p":
+		size = PB
+	case "ki":
+		size = KiB
+	case "mi":
+		size = MiB
+	case "gi":
+		size = GiB
+	case "ti":
+		size = TiB
+	case "pi":
+		size = PiB
+	default:
+		return 0, fmt.Errorf("invalid byte size unit %q", s[i:])
+	}
+	// Whole numbers are multiplied exactly, as float64 can't hold every int64
+	if n, err := strconv.ParseInt(number, 10, 64); err == nil {
+		if n > math.MaxInt64/int64(size) || n < math.MinInt64/int64(size) {
+			return 0, fmt.Errorf("byte size %q out of range", s)
+		}
+		return ByteSize(n) * size, nil
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid byte size %q", s)
+	}
+	bytes := math.Round(n * float64(size))
+	if bytes >= math.MaxInt64 || bytes < math.MinInt64 {
+		return 0, fmt.Errorf("byte size %q out of range", s)
+	}
+	return ByteSize(bytes), nil
+}
+
+// String returns the size using the largest unit that represents it exactly
+func (b ByteSize) String() string {
+	for _, unit := range byteSizeUnits {
+		if b != 0 && b%unit.size == 0 {
+			return strconv.FormatInt(int64(b/unit.size), 10) + unit.name
+		}
+	}
+	return strconv.FormatInt(int64(b), 10) + "B"
+}
+
+func (b ByteSize) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	size, err := ParseByteSize(string(text))
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+// UnmarshalJSON accepts a plain number of bytes as well as a string with a unit
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	text, err := jsonText(data)
+	if err != nil {
+		return err
+	}
+	return b.UnmarshalText(text)
+}
+
+// Percent is a percentage, written as "75%". Its value is in percentage points.
+type Percent float64
+
+// ParsePercent parses a percentage such as "75%" or "12.5"
+func ParsePercent(s string) (Percent, error) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "%")
+	p, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid percentage %q", s)
+	}
+	return Percent(p), nil
+}
+
+// Fraction returns the percentage as a fraction, eg. 0.75 for 75%
+func (p Percent) Fraction() float64 {
+	return float64(p) / 100
+}
+
+func (p Percent) String() string {
+	return strconv.FormatFloat(float64(p), 'f', -1, 64) + "%"
+}
+
+func (p Percent) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Percent) UnmarshalText(text []byte) error {
+	percent, err := ParsePercent(string(text))
+	if err != nil {
+		return err
+	}
+	*p = percent
+	return nil
+}
+
+// UnmarshalJSON accepts a plain number of percentage points as well as a string
+func (p *Percent) UnmarshalJSON(data []byte) error {
+	text, err := jsonText(data)
+	if err != nil {
+		return err
+	}
+	return p.UnmarshalText(text)
+}
+
+// Rate is a count per period of time, written as "100/s", "5/m" or "10/100ms"
+type Rate struct {
+	Count float64
+	Per   time.Duration
+}
+
+var rateUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+}
+
+// ParseRate parses a rate such as "100/s", "5/m" or "10/100ms"
+func ParseRate(s string) (Rate, error) {
+	count, per, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("invalid rate %q, expected count/period", s)
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(count), 64)
+	if err != nil {
+		return Rate{}, fmt.Errorf("invalid rate %q", s)
+	}
+	per = strings.TrimSpace(per)
+	period, ok := rateUnits[per]
+	if !ok {
+		period, err = time.ParseDuration(per)
+		if err != nil || period <= 0 {
+			return Rate{}, fmt.Errorf("invalid rate period %q", per)
+		}
+	}
+	return Rate{Count: n, Per: period}, nil
+}
+
+// PerSecond returns the rate as a count per second
+func (r Rate) PerSecond() float64 {
+	if r.Per == 0 {
+		return 0
+	}
+	return r.Count / r.Per.Seconds()
+}
+
+// Interval returns the time between events at this rate
+func (r Rate) Interval() time.Duration {
+	if r.Count == 0 {
+		return 0
+	}
+	return time.Duration(float64(r.Per) / r.Count)
+}
+
+func (r Rate) String() string {
+	count := strconv.FormatFloat(r.Count, 'f', -1, 64)
+	for _, unit := range []string{"d", "h", "m", "s", "ms", "us", "ns"} {
+		if r.Per == rateUnits[unit] {
+			return count + "/" + unit
+		}
+	}
+	return count + "/" + r.Per.String()
+}
+
+func (r Rate) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Rate) UnmarshalText(text []byte) error {
+	rate, err := ParseRate(string(text))
+	if err != nil {
+		return err
+	}
+	*r = rate
+	return nil
+}
+
+// jsonText returns the contents of a JSON string, or the raw text of a JSON number, so both
+// can be given to UnmarshalText
+func jsonText(data []byte) ([]byte, error) {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		return []byte(s), nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return nil, err
+	}
+	return []byte(n), nil
+}
@@ -0,0 +1,95 @@
+package cfggo
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Validator is implemented by config values, or the elements of slice and map values, that can
+// check themselves. Validate is called whenever the value is loaded or set.
+type Validator interface {
+	Validate() error
+}
+
+// validateValue validates value, and each element of slice, array and map values, returning an
+// error naming the key (and element) that failed
+func validateValue(key string, value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	if err := validateElem(reflect.ValueOf(value)); err != nil {
+		return ErrorWrapper(err, 400, "invalid value for key %s: %v", key, err)
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := validateElem(v.Index(i)); err != nil {
+				return ErrorWrapper(err, 400, "invalid value for key %s[%d]: %v", key, i, err)
+			}
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := validateElem(iter.Value()); err != nil {
+				return ErrorWrapper(err, 400, "invalid value for key %s[%v]: %v", key, iter.Key(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateValue validates value like the validateValue function, and checks that it, or each
+// element of slice and array values, is one of the values allowed by the key's oneof tag
+func (c *Structure) validateValue(key string, value interface{}) error {
+	if err := validateValue(key, value); err != nil {
+		return err
+	}
+	allowed := c.oneOf[key]
+	if len(allowed) == 0 || value == nil {
+		return nil
+	}
+
+	v := reflect.ValueOf(value)
+	if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+		for i := 0; i < v.Len(); i++ {
+			if !isOneOf(v.Index(i), allowed) {
+				return ErrorWrapper(nil, 400, "invalid value for key %s[%d], expected one of %s", key, i, strings.Join(allowed, ", "))
+			}
+		}
+		return nil
+	}
+	if !isOneOf(v, allowed) {
+		return ErrorWrapper(nil, 400, "invalid value for key %s, expected one of %s", key, strings.Join(allowed, ", "))
+	}
+	return nil
+}
+
+// isOneOf reports whether v, formatted as in the oneof tag, is one of allowed
+func isOneOf(v reflect.Value, allowed []string) bool {
+	s := fmt.Sprint(v.Interface())
+	for _, a := range allowed {
+		if s == a {
+			return true
+		}
+	}
+	return false
+}
+
+// validateElem calls Validate on v if it, or a pointer to it, implements Validator
+func validateElem(v reflect.Value) error {
+	if !v.IsValid() || (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return nil
+	}
+	if validator, ok := v.Interface().(Validator); ok {
+		return validator.Validate()
+	}
+	ptr := reflect.New(v.Type())
+	ptr.Elem().Set(v)
+	if validator, ok := ptr.Interface().(Validator); ok {
+		return validator.Validate()
+	}
+	return nil
+}